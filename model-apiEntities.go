@@ -1,5 +1,10 @@
 package api_common
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type ErrorData struct {
 	Error Error `json:"error"`
 }
@@ -34,14 +39,26 @@ type NotificationData struct {
 	Notification Notification `json:"notification,omitempty"`
 }
 
+// Monitor describes an API call. The fields after Endpoint are sent since
+// version 2 of EVENT_TYPE_MONITOR and are empty in older messages
 type Monitor struct {
-	Response   string `json:"response,omitempty"`
-	Uuid       string `json:"uuid,omitempty"`
-	Source     string `json:"source,omitempty"`
-	SourceType string `json:"source_type,omitempty"`
-	Success    bool   `json:"success,omitempty"`
-	Status     int    `json:"status,omitempty"`
-	Endpoint   string `json:"endpoint,omitempty"`
+	Response     string     `json:"response,omitempty"`
+	Uuid         string     `json:"uuid,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	SourceType   string     `json:"source_type,omitempty"`
+	Success      bool       `json:"success,omitempty"`
+	Status       int        `json:"status,omitempty"`
+	Endpoint     string     `json:"endpoint,omitempty"`
+	Method       string     `json:"method,omitempty"`
+	Route        string     `json:"route,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	DurationMs   float64    `json:"duration_ms,omitempty"`
+	RequestSize  int        `json:"request_size,omitempty"`
+	ResponseSize int        `json:"response_size,omitempty"`
+	Actor        string     `json:"actor,omitempty"`
+	Org          string     `json:"org,omitempty"`
+	Ips          []string   `json:"ips,omitempty"`
+	UserAgent    string     `json:"user_agent,omitempty"`
 }
 
 type Notification struct {
@@ -76,3 +93,19 @@ type RabbitReply struct {
 	Queue    string `json:"queue,omitempty"`
 	Key      string `json:"key,omitempty"`
 }
+
+type RpcRequest struct {
+	Data RpcRequestData `json:"data"`
+}
+
+type RpcRequestData struct {
+	Method      string          `json:"method"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	RabbitReply RabbitReply     `json:"rabbit_reply,omitempty"`
+}
+
+type RpcResponse struct {
+	Status bool            `json:"status"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
@@ -13,13 +13,20 @@ type MicroService struct {
 }
 
 type Database struct {
-	Name                  string `yaml:"name"`
-	SslEnabled            bool   `yaml:"sslEnabled"`
-	Address               string `yaml:"address"`
-	Port                  int    `yaml:"port"`
-	Username              string `yaml:"username"`
-	PasswordFilepath      string `yaml:"passwordFilepath"`
-	EncryptionKeyFilepath string `yaml:"encryptionKeyFilepath"`
+	Name                  string          `yaml:"name"`
+	SslEnabled            bool            `yaml:"sslEnabled"`
+	Address               string          `yaml:"address"`
+	Port                  int             `yaml:"port"`
+	Username              string          `yaml:"username"`
+	PasswordFilepath      string          `yaml:"passwordFilepath"`
+	EncryptionKeyFilepath string          `yaml:"encryptionKeyFilepath"`
+	EncryptionKeys        []EncryptionKey `yaml:"encryptionKeys"`
+}
+
+type EncryptionKey struct {
+	Kid      string `yaml:"kid"`
+	Filepath string `yaml:"filepath"`
+	Primary  bool   `yaml:"primary"`
 }
 
 type Common struct {
@@ -27,11 +34,12 @@ type Common struct {
 }
 
 type Rabbit struct {
-	Url          string     `yaml:"url"`
-	Producer     RabbitInfo `yaml:"producer"`
-	Consumer     RabbitInfo `yaml:"consumer"`
-	Monitor      RabbitInfo `yaml:"monitor"`
-	Notification RabbitInfo `yaml:"notification"`
+	Url          string         `yaml:"url"`
+	Producer     RabbitInfo     `yaml:"producer"`
+	Consumer     RabbitInfo     `yaml:"consumer"`
+	Monitor      RabbitInfo     `yaml:"monitor"`
+	Notification RabbitInfo     `yaml:"notification"`
+	Topology     RabbitTopology `yaml:"topology"`
 }
 type Application struct {
 	Name            string     `yaml:"name"`
@@ -39,11 +47,52 @@ type Application struct {
 	Jwt             Jwt        `yaml:"jwt"`
 	CorsPolicy      CorsPolicy `yaml:"corsPolicy"`
 	MaxFailedLogins int        `yaml:"maxFailedLogins"`
+	Lockout         Lockout    `yaml:"lockout"`
+	Totp            Totp       `yaml:"totp"`
+	Otp             Otp        `yaml:"otp"`
+	Redaction       Redaction  `yaml:"redaction"`
 	Password        Password   `yaml:"password"`
 	Template        Template   `yaml:"template"`
 	Config          Config     `yaml:"config"`
 }
 
+type Lockout struct {
+	MaxFailedLoginsPerIp int     `yaml:"maxFailedLoginsPerIp"`
+	WindowMinutes        int     `yaml:"windowMinutes"`
+	DurationMinutes      int     `yaml:"durationMinutes"`
+	MaxDurationMinutes   int     `yaml:"maxDurationMinutes"`
+	BackoffMultiplier    float64 `yaml:"backoffMultiplier"`
+}
+
+type Redaction struct {
+	RulesFilepath string          `yaml:"rulesFilepath"`
+	Rules         []RedactionRule `yaml:"rules"`
+}
+
+type RedactionRule struct {
+	Name   string   `yaml:"name"`
+	Keys   []string `yaml:"keys"`
+	Paths  []string `yaml:"paths"`
+	Action string   `yaml:"action"`
+}
+
+type Totp struct {
+	Issuer                string `yaml:"issuer"`
+	Digits                int    `yaml:"digits"`
+	PeriodSeconds         int    `yaml:"periodSeconds"`
+	Skew                  int    `yaml:"skew"`
+	RecoveryCodes         int    `yaml:"recoveryCodes"`
+	EncryptionKeyFilepath string `yaml:"encryptionKeyFilepath"`
+}
+
+type Otp struct {
+	CodeLength    int    `yaml:"codeLength"`
+	TokenLength   int    `yaml:"tokenLength"`
+	TtlMinutes    int    `yaml:"ttlMinutes"`
+	MaxAttempts   int    `yaml:"maxAttempts"`
+	MagicLinkPath string `yaml:"magicLinkPath"`
+}
+
 type Config struct {
 	Import string `yaml:"import"`
 	Update string `yaml:"update"`
@@ -67,6 +116,41 @@ type RabbitInfo struct {
 	Exchange string `yaml:"exchange"`
 }
 
+type RabbitTopology struct {
+	DeclareOnStartup bool             `yaml:"declareOnStartup"`
+	Exchanges        []RabbitExchange `yaml:"exchanges"`
+	Queues           []RabbitQueue    `yaml:"queues"`
+	Bindings         []RabbitBinding  `yaml:"bindings"`
+}
+
+type RabbitExchange struct {
+	Name       string `yaml:"name"`
+	Type       string `yaml:"type"`
+	Durable    bool   `yaml:"durable"`
+	AutoDelete bool   `yaml:"autoDelete"`
+	Internal   bool   `yaml:"internal"`
+}
+
+type RabbitQueue struct {
+	Name                 string `yaml:"name"`
+	Durable              bool   `yaml:"durable"`
+	AutoDelete           bool   `yaml:"autoDelete"`
+	Exclusive            bool   `yaml:"exclusive"`
+	Quorum               bool   `yaml:"quorum"`
+	MessageTtlMs         int64  `yaml:"messageTtlMs"`
+	MaxLength            int64  `yaml:"maxLength"`
+	MaxLengthBytes       int64  `yaml:"maxLengthBytes"`
+	Overflow             string `yaml:"overflow"`
+	DeadLetterExchange   string `yaml:"deadLetterExchange"`
+	DeadLetterRoutingKey string `yaml:"deadLetterRoutingKey"`
+}
+
+type RabbitBinding struct {
+	Exchange string `yaml:"exchange"`
+	Queue    string `yaml:"queue"`
+	Key      string `yaml:"key"`
+}
+
 type Jwt struct {
 	Api Api `yaml:"api"`
 }
@@ -87,8 +171,41 @@ type Api struct {
 }
 
 type Password struct {
-	PwdDuration int `yaml:"pwdDuration"`
-	PwdWarning  int `yaml:"pwdWarning"`
+	PwdDuration int             `yaml:"pwdDuration"`
+	PwdWarning  int             `yaml:"pwdWarning"`
+	Hashing     PasswordHashing `yaml:"hashing"`
+	Policy      PasswordPolicy  `yaml:"policy"`
+}
+
+type PasswordPolicy struct {
+	MinLength           int    `yaml:"minLength"`
+	MaxLength           int    `yaml:"maxLength"`
+	MinLower            int    `yaml:"minLower"`
+	MinUpper            int    `yaml:"minUpper"`
+	MinNumeric          int    `yaml:"minNumeric"`
+	MinSpecial          int    `yaml:"minSpecial"`
+	MaxRepeatedChars    int    `yaml:"maxRepeatedChars"`
+	BannedWordsFilepath string `yaml:"bannedWordsFilepath"`
+	HistoryDepth        int    `yaml:"historyDepth"`
+}
+
+type PasswordHashing struct {
+	Algorithm      string       `yaml:"algorithm"`
+	PepperFilepath string       `yaml:"pepperFilepath"`
+	Argon2         Argon2Params `yaml:"argon2"`
+	Bcrypt         BcryptParams `yaml:"bcrypt"`
+}
+
+type Argon2Params struct {
+	Memory      uint32 `yaml:"memory"`
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+	SaltLength  uint32 `yaml:"saltLength"`
+	KeyLength   uint32 `yaml:"keyLength"`
+}
+
+type BcryptParams struct {
+	Cost int `yaml:"cost"`
 }
 
 type Token struct {
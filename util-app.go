@@ -3,26 +3,83 @@ package api_common
 import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"strings"
 )
 
+// AppConfig contains the settings used by ConfigureAppWithConfig
+type AppConfig struct {
+	AllowedDomains []string
+	// RequestIdGenerator generates the request id of each call, e.g.
+	// RequestIdGeneratorUuidV7 or RequestIdGeneratorUlid. If nil a random
+	// 24 characters id is generated
+	RequestIdGenerator func() string
+	// RequestIdMinLength and RequestIdMaxLength bound the length of an
+	// accepted inbound X-Request-ID (see RequestIdConfig)
+	RequestIdMinLength int
+	RequestIdMaxLength int
+	// Tracer, if set, traces every request and becomes the tracer
+	// returned by GetTracer
+	Tracer *Tracer
+	// MetricsEnabled installs MetricsMiddleware and serves the metrics
+	// of DefaultMetricsRegistry on MetricsPath (METRICS_PATH if empty).
+	// The metrics are public unless MetricsAuth is set, e.g. to
+	// RequiresAccessToken or a basic auth middleware
+	MetricsEnabled bool
+	MetricsPath    string
+	MetricsAuth    fiber.Handler
+	// Health, if set, is served on HEALTH_PATH_LIVE and HEALTH_PATH_READY
+	Health *HealthRegistry
+}
+
+// ConfigureApp creates the fiber app with the common middlewares, the
+// metrics of DefaultMetricsRegistry served on METRICS_PATH and the checks
+// of DefaultHealthRegistry served on HEALTH_PATH_LIVE and HEALTH_PATH_READY.
+// The metrics are served without authentication: do not route
+// METRICS_PATH through the public gateway, or use ConfigureAppWithConfig
+// with MetricsAuth
 func ConfigureApp(allowedDomains []string) *fiber.App {
+	return ConfigureAppWithConfig(AppConfig{AllowedDomains: allowedDomains, MetricsEnabled: true, Health: DefaultHealthRegistry})
+}
+
+// ConfigureAppWithConfig creates the fiber app with the common
+// middlewares configured by config
+func ConfigureAppWithConfig(config AppConfig) *fiber.App {
 	app := fiber.New()
 
 	// use default cors config
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: strings.Join(allowedDomains, ","),
+		AllowOrigins: strings.Join(config.AllowedDomains, ","),
 	}))
 
-	// generate random request id for each call
-	app.Use(requestid.New(requestid.Config{
-		Header: HTTP_HEADER_REQUEST_ID,
-		Generator: func() string {
-			return RandomGenerateUuidWithLength(false, 24)
-		},
-		ContextKey: CTX_REQUESTID,
+	// propagate the inbound request id or generate a new one for each call
+	app.Use(RequestIdMiddleware(RequestIdConfig{
+		Generator: config.RequestIdGenerator,
+		MinLength: config.RequestIdMinLength,
+		MaxLength: config.RequestIdMaxLength,
 	}))
 
+	if config.MetricsEnabled {
+		metricsPath := config.MetricsPath
+		if metricsPath == "" {
+			metricsPath = METRICS_PATH
+		}
+		app.Use(MetricsMiddleware())
+		if config.MetricsAuth != nil {
+			app.Get(metricsPath, config.MetricsAuth, MetricsHandler())
+		} else {
+			app.Get(metricsPath, MetricsHandler())
+		}
+	}
+
+	if config.Health != nil {
+		app.Get(HEALTH_PATH_LIVE, LivenessHandler(config.Health))
+		app.Get(HEALTH_PATH_READY, ReadinessHandler(config.Health))
+	}
+
+	if config.Tracer != nil {
+		SetTracer(config.Tracer)
+		app.Use(TracingMiddleware(config.Tracer))
+	}
+
 	return app
 }
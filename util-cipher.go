@@ -0,0 +1,283 @@
+package api_common
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CIPHER_STREAM_CHUNK_SIZE is the default plaintext size of each chunk
+// written by the streaming encryption
+const CIPHER_STREAM_CHUNK_SIZE = 64 * 1024
+
+var cipherStreamMagic = []byte("ACS1")
+
+const cipherStreamPrefixSize = 7
+const cipherStreamHeaderSize = 4 + 4 + cipherStreamPrefixSize
+
+// Cipher performs AES-256-GCM authenticated encryption with a key set
+// once at construction. Nonces are read from crypto/rand and prepended
+// to the ciphertext, so the output of Seal is nonce+ciphertext
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher for the given 32 bytes key
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cannot create aes-256 cipher, missing 32 bytes encryption key (passed a key of length %d)",
+			len(key))
+	}
+	aes256Cipher, errNewCipher := aes.NewCipher(key)
+	if errNewCipher != nil {
+		return nil, fmt.Errorf("cannot create aes-256 cipher: %s", errNewCipher)
+	}
+	gcm, errNewGcm := cipher.NewGCM(aes256Cipher)
+	if errNewGcm != nil {
+		return nil, fmt.Errorf("cannot create gcm: %s", errNewGcm.Error())
+	}
+	return &Cipher{aead: gcm}, nil
+}
+
+// CryptoAAD builds additional authenticated data from the given parts,
+// e.g. CryptoAAD("users", "email", userId). Every part is length
+// prefixed so that different splits never produce the same value
+func CryptoAAD(parts ...string) []byte {
+	var aad []byte
+	for _, part := range parts {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(part)))
+		aad = append(aad, length...)
+		aad = append(aad, part...)
+	}
+	return aad
+}
+
+// NonceSize returns the size of the nonce prepended to every ciphertext
+func (c *Cipher) NonceSize() int {
+	return c.aead.NonceSize()
+}
+
+// Seal encrypts plainText binding it to the optional aad and returns
+// nonce+ciphertext
+func (c *Cipher) Seal(plainText []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plainText)+c.aead.Overhead())
+	_, errRandRead := rand.Read(nonce)
+	if errRandRead != nil {
+		return nil, fmt.Errorf("cannot create random nonce: %s", errRandRead.Error())
+	}
+	return c.aead.Seal(nonce, nonce, plainText, aad), nil
+}
+
+// Open decrypts a nonce+ciphertext produced by Seal with the same aad
+func (c *Cipher) Open(sealed []byte, aad []byte) ([]byte, error) {
+	if len(sealed) <= c.aead.NonceSize() {
+		return nil, fmt.Errorf("cannot decrypt text with invalid length")
+	}
+	plainText, errGcmOpen := c.aead.Open(nil, sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():], aad)
+	if errGcmOpen != nil {
+		return nil, fmt.Errorf("cannot decrypt text with gcm open: %s", errGcmOpen.Error())
+	}
+	return plainText, nil
+}
+
+// SealString encrypts plainText and returns the hex encoded
+// nonce+ciphertext, the same format of CryptoEncryptText
+func (c *Cipher) SealString(plainText string, aad []byte) (string, error) {
+	sealed, errSeal := c.Seal([]byte(plainText), aad)
+	if errSeal != nil {
+		return "", errSeal
+	}
+	return hex.EncodeToString(sealed), nil
+}
+
+// OpenString decrypts a hex encoded value produced by SealString
+func (c *Cipher) OpenString(encryptedText string, aad []byte) (string, error) {
+	sealed, errHexDecodeString := hex.DecodeString(encryptedText)
+	if errHexDecodeString != nil {
+		return "", fmt.Errorf("cannot hex decode string: %s", errHexDecodeString.Error())
+	}
+	plainText, errOpen := c.Open(sealed, aad)
+	if errOpen != nil {
+		return "", errOpen
+	}
+	return string(plainText), nil
+}
+
+// NewEncryptWriter returns a writer encrypting everything written to it
+// into w, in authenticated chunks of chunkSize bytes (CIPHER_STREAM_CHUNK_SIZE
+// if chunkSize <= 0). Close must be called to write the final chunk,
+// otherwise the stream is rejected as truncated on decryption
+func (c *Cipher) NewEncryptWriter(w io.Writer, aad []byte, chunkSize int) (io.WriteCloser, error) {
+	if c.aead.NonceSize() != cipherStreamPrefixSize+5 {
+		return nil, fmt.Errorf("cannot create stream: unsupported nonce size %d", c.aead.NonceSize())
+	}
+	if chunkSize <= 0 {
+		chunkSize = CIPHER_STREAM_CHUNK_SIZE
+	}
+	header := make([]byte, cipherStreamHeaderSize)
+	copy(header, cipherStreamMagic)
+	binary.BigEndian.PutUint32(header[4:8], uint32(chunkSize))
+	if _, errRandRead := rand.Read(header[8:]); errRandRead != nil {
+		return nil, fmt.Errorf("cannot create random nonce prefix: %s", errRandRead.Error())
+	}
+	if _, errWrite := w.Write(header); errWrite != nil {
+		return nil, fmt.Errorf("cannot write stream header: %s", errWrite.Error())
+	}
+	return &cipherStreamWriter{
+		aead:      c.aead,
+		w:         w,
+		aad:       append(append([]byte{}, header...), aad...),
+		prefix:    header[8:],
+		chunkSize: chunkSize,
+		buffer:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// NewDecryptReader returns a reader decrypting a stream written by
+// NewEncryptWriter with the same aad. Reads fail if any chunk has been
+// modified, reordered or if the stream has been truncated
+func (c *Cipher) NewDecryptReader(r io.Reader, aad []byte) (io.Reader, error) {
+	if c.aead.NonceSize() != cipherStreamPrefixSize+5 {
+		return nil, fmt.Errorf("cannot create stream: unsupported nonce size %d", c.aead.NonceSize())
+	}
+	header := make([]byte, cipherStreamHeaderSize)
+	if _, errRead := io.ReadFull(r, header); errRead != nil {
+		return nil, fmt.Errorf("cannot read stream header: %s", errRead.Error())
+	}
+	if string(header[:4]) != string(cipherStreamMagic) {
+		return nil, fmt.Errorf("cannot read stream: invalid header")
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[4:8]))
+	if chunkSize <= 0 || chunkSize > 64*1024*1024 {
+		return nil, fmt.Errorf("cannot read stream: invalid chunk size %d", chunkSize)
+	}
+	return &cipherStreamReader{
+		aead:      c.aead,
+		r:         bufio.NewReader(r),
+		aad:       append(append([]byte{}, header...), aad...),
+		prefix:    header[8:],
+		chunkSize: chunkSize,
+		record:    make([]byte, chunkSize+c.aead.Overhead()),
+	}, nil
+}
+
+func cipherStreamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, cipherStreamPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cipherStreamPrefixSize:], counter)
+	if last {
+		nonce[cipherStreamPrefixSize+4] = 1
+	}
+	return nonce
+}
+
+type cipherStreamWriter struct {
+	aead      cipher.AEAD
+	w         io.Writer
+	aad       []byte
+	prefix    []byte
+	chunkSize int
+	buffer    []byte
+	counter   uint32
+	closed    bool
+}
+
+func (s *cipherStreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("cannot write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full buffer is flushed only when more data arrives, so the
+		// last chunk is always written by Close
+		if len(s.buffer) == s.chunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buffer[len(s.buffer):s.chunkSize], p)
+		s.buffer = s.buffer[:len(s.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *cipherStreamWriter) flush(last bool) error {
+	if s.counter == ^uint32(0) {
+		return errors.New("cannot write stream: too many chunks")
+	}
+	sealed := s.aead.Seal(nil, cipherStreamNonce(s.prefix, s.counter, last), s.buffer, s.aad)
+	if _, err := s.w.Write(sealed); err != nil {
+		return fmt.Errorf("cannot write stream chunk: %s", err.Error())
+	}
+	s.counter++
+	s.buffer = s.buffer[:0]
+	return nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer
+func (s *cipherStreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+type cipherStreamReader struct {
+	aead      cipher.AEAD
+	r         *bufio.Reader
+	aad       []byte
+	prefix    []byte
+	chunkSize int
+	record    []byte
+	plain     []byte
+	counter   uint32
+	done      bool
+}
+
+func (s *cipherStreamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *cipherStreamReader) next() error {
+	n, errRead := io.ReadFull(s.r, s.record)
+	if errRead != nil && errRead != io.ErrUnexpectedEOF {
+		if errRead == io.EOF {
+			return errors.New("cannot read stream: truncated stream")
+		}
+		return fmt.Errorf("cannot read stream chunk: %s", errRead.Error())
+	}
+	last := n < len(s.record)
+	if !last {
+		if _, errPeek := s.r.Peek(1); errPeek == io.EOF {
+			last = true
+		}
+	}
+	plain, errOpen := s.aead.Open(nil, cipherStreamNonce(s.prefix, s.counter, last), s.record[:n], s.aad)
+	if errOpen != nil {
+		return fmt.Errorf("cannot decrypt stream chunk %d: %s", s.counter, errOpen.Error())
+	}
+	s.counter++
+	s.plain = plain
+	s.done = last
+	return nil
+}
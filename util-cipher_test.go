@@ -0,0 +1,140 @@
+package api_common
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func newTestCipher(t *testing.T) *Cipher {
+	aes256Cipher, err := NewCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("cannot create cipher: %s", err.Error())
+	}
+	return aes256Cipher
+}
+
+func TestCipherSealOpen(t *testing.T) {
+	aes256Cipher := newTestCipher(t)
+	aad := CryptoAAD("users", "email", "42")
+	sealed, err := aes256Cipher.Seal([]byte("secret"), aad)
+	if err != nil {
+		t.Fatalf("cannot seal: %s", err.Error())
+	}
+	again, _ := aes256Cipher.Seal([]byte("secret"), aad)
+	if bytes.Equal(sealed[:aes256Cipher.NonceSize()], again[:aes256Cipher.NonceSize()]) {
+		t.Errorf("expected a new nonce for every seal")
+	}
+	plainText, err := aes256Cipher.Open(sealed, aad)
+	if err != nil || string(plainText) != "secret" {
+		t.Fatalf("expected secret, got %q (%v)", plainText, err)
+	}
+	if _, err = aes256Cipher.Open(sealed, CryptoAAD("users", "email", "43")); err == nil {
+		t.Errorf("expected an error opening with a different aad")
+	}
+	if _, err = aes256Cipher.Open(sealed, nil); err == nil {
+		t.Errorf("expected an error opening without the aad")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err = aes256Cipher.Open(sealed, aad); err == nil {
+		t.Errorf("expected an error opening a modified ciphertext")
+	}
+	if _, err = aes256Cipher.Open(sealed[:aes256Cipher.NonceSize()], aad); err == nil {
+		t.Errorf("expected an error opening a ciphertext without body")
+	}
+}
+
+func TestCryptoAADIsUnambiguous(t *testing.T) {
+	if bytes.Equal(CryptoAAD("ab", "c"), CryptoAAD("a", "bc")) {
+		t.Errorf("expected different aad for different splits")
+	}
+}
+
+func encryptTestStream(t *testing.T, aes256Cipher *Cipher, plainText []byte, aad []byte, chunkSize int) []byte {
+	var buffer bytes.Buffer
+	writer, err := aes256Cipher.NewEncryptWriter(&buffer, aad, chunkSize)
+	if err != nil {
+		t.Fatalf("cannot create encrypt writer: %s", err.Error())
+	}
+	if _, err = writer.Write(plainText); err != nil {
+		t.Fatalf("cannot write stream: %s", err.Error())
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("cannot close stream: %s", err.Error())
+	}
+	return buffer.Bytes()
+}
+
+func decryptTestStream(aes256Cipher *Cipher, stream []byte, aad []byte) ([]byte, error) {
+	reader, err := aes256Cipher.NewDecryptReader(bytes.NewReader(stream), aad)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestCipherStreamRoundTrip(t *testing.T) {
+	aes256Cipher := newTestCipher(t)
+	aad := CryptoAAD("files", "7")
+	for _, size := range []int{0, 1, 15, 16, 17, 48, 50} {
+		plainText := bytes.Repeat([]byte{'x'}, size)
+		stream := encryptTestStream(t, aes256Cipher, plainText, aad, 16)
+		chunks := (size + 15) / 16
+		if chunks == 0 {
+			chunks = 1
+		}
+		overhead := cipherStreamHeaderSize + chunks*16
+		if len(stream) != size+overhead {
+			t.Errorf("size %d: expected %d chunks in %d bytes, got %d bytes", size, chunks, size+overhead, len(stream))
+		}
+		decrypted, err := decryptTestStream(aes256Cipher, stream, aad)
+		if err != nil || !bytes.Equal(decrypted, plainText) {
+			t.Errorf("size %d: expected the plain text back, got %d bytes (%v)", size, len(decrypted), err)
+		}
+	}
+}
+
+func TestCipherStreamRejectsTampering(t *testing.T) {
+	aes256Cipher := newTestCipher(t)
+	aad := CryptoAAD("files", "7")
+	// three records of 32 bytes: two full chunks and the last one
+	stream := encryptTestStream(t, aes256Cipher, bytes.Repeat([]byte{'x'}, 40), aad, 16)
+	record := 16 + 16
+	header := cipherStreamHeaderSize
+
+	swapped := append([]byte{}, stream...)
+	copy(swapped[header:], stream[header+record:header+2*record])
+	copy(swapped[header+record:], stream[header:header+record])
+
+	tests := []struct {
+		name   string
+		stream []byte
+		aad    []byte
+	}{
+		{name: "aad mismatch", stream: stream, aad: CryptoAAD("files", "8")},
+		{name: "truncated at a chunk boundary", stream: stream[:header+2*record], aad: aad},
+		{name: "truncated after the first chunk", stream: stream[:header+record], aad: aad},
+		{name: "truncated inside a chunk", stream: stream[:header+record+5], aad: aad},
+		{name: "without chunks", stream: stream[:header], aad: aad},
+		{name: "reordered chunks", stream: swapped, aad: aad},
+		{name: "appended chunk", stream: append(append([]byte{}, stream...), stream[header:header+record]...), aad: aad},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decryptTestStream(aes256Cipher, test.stream, test.aad); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestCipherStreamLastFlag(t *testing.T) {
+	nonce := cipherStreamNonce(make([]byte, cipherStreamPrefixSize), 1, false)
+	last := cipherStreamNonce(make([]byte, cipherStreamPrefixSize), 1, true)
+	if bytes.Equal(nonce, last) {
+		t.Errorf("expected the last flag to change the nonce")
+	}
+	if bytes.Equal(nonce, cipherStreamNonce(make([]byte, cipherStreamPrefixSize), 2, false)) {
+		t.Errorf("expected the counter to change the nonce")
+	}
+}
@@ -4,6 +4,10 @@ package api_common
 const API_CODE_COMMON_BAD_REQUEST = "BAD_REQUEST"
 const API_CODE_COMMON_UNAUTHORIZED = "UNAUTHORIZED"
 const API_CODE_COMMON_INTERNAL_SERVER_ERROR = "INTERNAL_SERVER_ERROR"
+const API_CODE_COMMON_PASSWORD_POLICY = "PASSWORD_POLICY"
+const API_CODE_COMMON_TOO_MANY_REQUESTS = "TOO_MANY_REQUESTS"
+const API_CODE_COMMON_METHOD_NOT_FOUND = "METHOD_NOT_FOUND"
+const API_CODE_COMMON_CONFLICT = "CONFLICT"
 
 // EXIT_CODES
 const EXIT_CODE_MISSING_CONFIG = 10
@@ -16,3 +20,25 @@ const HTTP_HEADER_REQUEST_ID = "X-Request-ID"
 // CTX_REQUESTID defines the key used when storing the request ID
 // in the locals for a specific request
 const CTX_REQUESTID = "requestid"
+
+// CTX_MONITOR defines the key used when storing the state of
+// MonitorMiddleware in the locals for a specific request
+const CTX_MONITOR = "monitor"
+
+// NOTIFY_TYPE_ACCOUNT_LOCKED is the notification type sent when an
+// account is locked after too many failed logins
+const NOTIFY_TYPE_ACCOUNT_LOCKED = "ACCOUNT_LOCKED"
+
+// JWT_CLAIM_MFA is the claim set to true in the tokens of sessions
+// that completed the two-factor authentication
+const JWT_CLAIM_MFA = "mfa"
+
+// HTTP_HEADER_TRACEPARENT and HTTP_HEADER_TRACESTATE are the W3C trace
+// context headers, used also as amqp headers
+const HTTP_HEADER_TRACEPARENT = "traceparent"
+const HTTP_HEADER_TRACESTATE = "tracestate"
+
+// HTTP_HEADER_IDEMPOTENCY_KEY identifies the retries of a request, whose
+// stored response is replayed with HTTP_HEADER_IDEMPOTENT_REPLAYED
+const HTTP_HEADER_IDEMPOTENCY_KEY = "Idempotency-Key"
+const HTTP_HEADER_IDEMPOTENT_REPLAYED = "Idempotent-Replayed"
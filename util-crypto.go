@@ -1,12 +1,9 @@
 package api_common
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"math/rand"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -46,26 +43,16 @@ func CryptoCompareHashedText(hashedText string, plainText string) bool {
 // encrypted value or an error
 func CryptoEncryptText(plainText string, encryptionKey string) (string, error) {
 	now := time.Now()
-	if len(encryptionKey) != 32 {
-		return "", fmt.Errorf("cannot create aes-256 cipher, missing 32 bytes encryption key (passed a key of length %d)",
-			len(encryptionKey))
-	}
-	aes256Cipher, errNewCipher := aes.NewCipher([]byte(encryptionKey))
+	aes256Cipher, errNewCipher := NewCipher([]byte(encryptionKey))
 	if errNewCipher != nil {
-		return "", fmt.Errorf("cannot create aes-256 cipher: %s", errNewCipher)
-	}
-	gcm, errNewGcm := cipher.NewGCM(aes256Cipher)
-	if errNewGcm != nil {
-		return "", fmt.Errorf("cannot create gcm: %s", errNewGcm.Error())
+		return "", errNewCipher
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	_, errRandRead := rand.Read(nonce)
-	if errRandRead != nil {
-		return "", fmt.Errorf("cannot create random nonce: %s", errRandRead.Error())
+	encryptedText, errSeal := aes256Cipher.SealString(plainText, nil)
+	if errSeal != nil {
+		return "", errSeal
 	}
-	encryptedText := gcm.Seal(nonce, nonce, []byte(plainText), nil)
 	log.Tracef("completed CryptoEncryptText operation in %s", time.Since(now))
-	return hex.EncodeToString(encryptedText), nil
+	return encryptedText, nil
 }
 
 // CryptoDecryptText executes decryption on the given encrypted
@@ -73,31 +60,16 @@ func CryptoEncryptText(plainText string, encryptionKey string) (string, error) {
 // the decrypted value or an error
 func CryptoDecryptText(encryptedText string, encryptionKey string) (string, error) {
 	now := time.Now()
-	if len(encryptionKey) != 32 {
-		return "", fmt.Errorf("cannot create aes-256 cipher, missing 32 bytes encryption key (passed a key of length %d)",
-			len(encryptionKey))
-	}
-	aes256Cipher, errNewCipher := aes.NewCipher([]byte(encryptionKey))
+	aes256Cipher, errNewCipher := NewCipher([]byte(encryptionKey))
 	if errNewCipher != nil {
-		return "", fmt.Errorf("cannot create aes-256 cipher: %s", errNewCipher)
-	}
-	gcm, errNewGcm := cipher.NewGCM(aes256Cipher)
-	if errNewGcm != nil {
-		return "", fmt.Errorf("cannot create gcm: %s", errNewGcm.Error())
-	}
-	baEncryptedText, errHexDecodeString := hex.DecodeString(encryptedText)
-	if errHexDecodeString != nil {
-		return "", fmt.Errorf("cannot hex decode string: %s", errHexDecodeString.Error())
-	}
-	if len(baEncryptedText) <= gcm.NonceSize() {
-		return "", fmt.Errorf("cannot decrypt text with invalid length")
+		return "", errNewCipher
 	}
-	plainText, errGcmOpen := gcm.Open(nil, baEncryptedText[:gcm.NonceSize()], baEncryptedText[gcm.NonceSize():], nil)
-	if errGcmOpen != nil {
-		return "", fmt.Errorf("cannot decrypt text with gcm open: %s", errGcmOpen.Error())
+	plainText, errOpen := aes256Cipher.OpenString(encryptedText, nil)
+	if errOpen != nil {
+		return "", errOpen
 	}
 	log.Tracef("completed CryptoDecryptText operation in %s", time.Since(now))
-	return string(plainText), nil
+	return plainText, nil
 }
 
 // CryptoSha256String returns the sha256 hash of the given input string
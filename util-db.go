@@ -14,7 +14,8 @@ import (
 )
 
 // GetDB open new connection pool.
-// This method have to be invokated only once, maybe you have to make some tuning for pool size
+// This method have to be invokated only once, maybe you have to make some tuning for pool size.
+// The query durations and the pool stats are exposed with DefaultMetricsRegistry
 func GetDB(serviceConfig *MicroserviceConfiguration, logLevel logger.LogLevel) (*gorm.DB, error) {
 	log.Traceln("calling GetDB method")
 	if serviceConfig == nil {
@@ -76,5 +77,11 @@ func GetDB(serviceConfig *MicroserviceConfiguration, logLevel logger.LogLevel) (
 		log.WithError(errOpenGORM).Error("cannot open gorm connection")
 		return nil, fmt.Errorf("cannot open gorm connection")
 	}
+	if errMetrics := RegisterGormMetrics(DB); errMetrics != nil {
+		return nil, errMetrics
+	}
+	if errMetrics := RegisterDBPoolMetrics(DB); errMetrics != nil {
+		return nil, errMetrics
+	}
 	return DB, nil
 }
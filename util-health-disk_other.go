@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package api_common
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func diskFreeBytes(path string) (uint64, error) {
+	return 0, fmt.Errorf("disk space check not supported on %s", runtime.GOOS)
+}
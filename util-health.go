@@ -0,0 +1,287 @@
+package api_common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+)
+
+// HEALTH_PATH_LIVE and HEALTH_PATH_READY are the paths of the liveness
+// and readiness endpoints mounted by ConfigureAppWithConfig
+const HEALTH_PATH_LIVE = "/health/live"
+const HEALTH_PATH_READY = "/health/ready"
+
+// HEALTH_STATUS_* are the status values of checks and reports
+const (
+	HEALTH_STATUS_UP       = "UP"
+	HEALTH_STATUS_DOWN     = "DOWN"
+	HEALTH_STATUS_STARTING = "STARTING"
+)
+
+const healthDefaultTimeout = 2 * time.Second
+const healthDefaultCacheTtl = 5 * time.Second
+
+// HealthCheck is a dependency check registered in a HealthRegistry.
+// Failing Required checks make the service not ready, the others are
+// only reported
+type HealthCheck struct {
+	Name     string
+	Check    func(ctx context.Context) error
+	Required bool
+	// Timeout bounds each execution of Check, 2 seconds by default
+	Timeout time.Duration
+	// CacheTtl is how long a result is reused, 5 seconds by default
+	CacheTtl time.Duration
+}
+
+// HealthCheckResult is the outcome of a HealthCheck
+type HealthCheckResult struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Required  bool      `json:"required"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// HealthReport is the body returned by the health endpoints
+type HealthReport struct {
+	Status string              `json:"status"`
+	Checks []HealthCheckResult `json:"checks,omitempty"`
+}
+
+type healthCheckState struct {
+	check  HealthCheck
+	mu     sync.Mutex
+	result HealthCheckResult
+	valid  bool
+}
+
+// HealthRegistry aggregates the health checks of a service. Readiness
+// stays down until every required check passed once (startup gate) and
+// can be forced down with SetReady, e.g. during shutdown
+type HealthRegistry struct {
+	mu       sync.RWMutex
+	checks   []*healthCheckState
+	started  int32
+	notReady int32
+}
+
+// NewHealthRegistry returns an empty HealthRegistry
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{}
+}
+
+// DefaultHealthRegistry is the registry served by ConfigureAppWithConfig
+// when health endpoints are enabled
+var DefaultHealthRegistry = NewHealthRegistry()
+
+// Register adds a check to the registry
+func (r *HealthRegistry) Register(check HealthCheck) {
+	if check.Timeout <= 0 {
+		check.Timeout = healthDefaultTimeout
+	}
+	if check.CacheTtl <= 0 {
+		check.CacheTtl = healthDefaultCacheTtl
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, &healthCheckState{check: check})
+}
+
+// SetReady forces the readiness down when false. When true, readiness
+// depends again on the checks
+func (r *HealthRegistry) SetReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&r.notReady, 0)
+	} else {
+		atomic.StoreInt32(&r.notReady, 1)
+	}
+}
+
+// Live returns the liveness report: the service is alive as long as it
+// can answer, dependencies are not checked
+func (r *HealthRegistry) Live() HealthReport {
+	return HealthReport{Status: HEALTH_STATUS_UP}
+}
+
+// Ready runs the checks, reusing cached results, and returns the
+// readiness report
+func (r *HealthRegistry) Ready(ctx context.Context) HealthReport {
+	r.mu.RLock()
+	states := append([]*healthCheckState{}, r.checks...)
+	r.mu.RUnlock()
+
+	results := make([]HealthCheckResult, len(states))
+	var wg sync.WaitGroup
+	for i, state := range states {
+		wg.Add(1)
+		go func(i int, state *healthCheckState) {
+			defer wg.Done()
+			results[i] = state.run(ctx)
+		}(i, state)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	status := HEALTH_STATUS_UP
+	for _, result := range results {
+		if result.Required && result.Status != HEALTH_STATUS_UP {
+			status = HEALTH_STATUS_DOWN
+		}
+	}
+	if atomic.LoadInt32(&r.started) == 0 {
+		if status == HEALTH_STATUS_UP {
+			atomic.StoreInt32(&r.started, 1)
+			log.Infoln("all required health checks passed, service is ready")
+		} else {
+			status = HEALTH_STATUS_STARTING
+		}
+	}
+	if atomic.LoadInt32(&r.notReady) == 1 {
+		status = HEALTH_STATUS_DOWN
+	}
+	return HealthReport{Status: status, Checks: results}
+}
+
+func (s *healthCheckState) run(ctx context.Context) HealthCheckResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.valid && time.Since(s.result.CheckedAt) < s.check.CacheTtl {
+		return s.result
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, s.check.Timeout)
+	defer cancel()
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				errCh <- fmt.Errorf("check panicked: %v", recovered)
+			}
+		}()
+		errCh <- s.check.Check(checkCtx)
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-checkCtx.Done():
+		err = fmt.Errorf("check timed out after %s", s.check.Timeout)
+	}
+	s.result = HealthCheckResult{
+		Name:      s.check.Name,
+		Status:    HEALTH_STATUS_UP,
+		Required:  s.check.Required,
+		LatencyMs: time.Since(start).Milliseconds(),
+		CheckedAt: time.Now().UTC(),
+	}
+	if err != nil {
+		s.result.Status = HEALTH_STATUS_DOWN
+		s.result.Error = err.Error()
+		log.WithError(err).Warnf("health check %s failed", s.check.Name)
+	}
+	s.valid = true
+	return s.result
+}
+
+// LivenessHandler serves the liveness report of the registry
+func LivenessHandler(registry *HealthRegistry) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.Status(200).JSON(registry.Live())
+	}
+}
+
+// ReadinessHandler serves the readiness report of the registry, with
+// status 200 if ready and 503 otherwise
+func ReadinessHandler(registry *HealthRegistry) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		report := registry.Ready(c.UserContext())
+		status := 200
+		if report.Status != HEALTH_STATUS_UP {
+			status = 503
+		}
+		return c.Status(status).JSON(report)
+	}
+}
+
+// DBHealthCheck pings the connection pool of db, e.g. returned by GetDB
+func DBHealthCheck(db *gorm.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return fmt.Errorf("cannot get database pool: %s", err.Error())
+		}
+		return sqlDB.PingContext(ctx)
+	}
+}
+
+// RabbitConnectionHealthCheck fails when the connection is closed
+func RabbitConnectionHealthCheck(conn *amqp.Connection) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if conn == nil || conn.IsClosed() {
+			return fmt.Errorf("rabbit connection closed")
+		}
+		return nil
+	}
+}
+
+// RabbitChannelHealthCheck fails once the channel has been closed, e.g.
+// the one returned by GetRabbitChannel
+func RabbitChannelHealthCheck(channel *amqp.Channel) func(ctx context.Context) error {
+	var closed int32
+	var closeErr atomic.Value
+	notify := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if amqpErr, ok := <-notify; ok && amqpErr != nil {
+			closeErr.Store(amqpErr.Error())
+		}
+		atomic.StoreInt32(&closed, 1)
+	}()
+	return func(ctx context.Context) error {
+		if atomic.LoadInt32(&closed) == 1 {
+			if reason, ok := closeErr.Load().(string); ok {
+				return fmt.Errorf("rabbit channel closed: %s", reason)
+			}
+			return fmt.Errorf("rabbit channel closed")
+		}
+		return nil
+	}
+}
+
+// SecretFilesHealthCheck fails if any of the secret files is not readable
+func SecretFilesHealthCheck(filepaths ...string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		for _, filepath := range filepaths {
+			file, err := os.Open(filepath)
+			if err != nil {
+				return fmt.Errorf("cannot read secret %s", filepath)
+			}
+			_ = file.Close()
+		}
+		return nil
+	}
+}
+
+// DiskSpaceHealthCheck fails if the filesystem of path has less than
+// minFreeBytes available
+func DiskSpaceHealthCheck(path string, minFreeBytes uint64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		free, err := diskFreeBytes(path)
+		if err != nil {
+			return fmt.Errorf("cannot get free disk space of %s: %s", path, err.Error())
+		}
+		if free < minFreeBytes {
+			return fmt.Errorf("free disk space of %s is %d bytes, below %d", path, free, minFreeBytes)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,322 @@
+package api_common
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const ulidAlphabet = RANDOM_ALPHABET_BASE32_CROCKFORD
+
+// UuidV7 is a RFC 9562 version 7 UUID: a 48 bits unix milliseconds
+// timestamp followed by a 12 bits counter and 62 random bits, so that
+// ids sort by creation time both as bytes and as strings
+type UuidV7 [16]byte
+
+// Ulid is a Universally Unique Lexicographically Sortable Identifier:
+// a 48 bits unix milliseconds timestamp followed by 80 random bits,
+// encoded as 26 Crockford base32 characters
+type Ulid [16]byte
+
+// IdGenerator generates UuidV7 and Ulid values that are strictly
+// increasing even when many ids are generated in the same millisecond
+type IdGenerator struct {
+	mu          sync.Mutex
+	uuidLastMs  uint64
+	uuidCounter uint16
+	ulidLastMs  uint64
+	ulidLast    Ulid
+	now         func() time.Time
+}
+
+// NewIdGenerator returns a new IdGenerator
+func NewIdGenerator() *IdGenerator {
+	return &IdGenerator{now: time.Now}
+}
+
+var defaultIdGenerator = NewIdGenerator()
+
+// NewUuidV7 returns a new UuidV7 from the default generator
+func NewUuidV7() (UuidV7, error) {
+	return defaultIdGenerator.NewUuidV7()
+}
+
+// NewUlid returns a new Ulid from the default generator
+func NewUlid() (Ulid, error) {
+	return defaultIdGenerator.NewUlid()
+}
+
+// NewUuidV7 returns a new UuidV7, greater than the previous one
+func (g *IdGenerator) NewUuidV7() (UuidV7, error) {
+	var id UuidV7
+	if _, err := rand.Read(id[6:]); err != nil {
+		return UuidV7{}, fmt.Errorf("cannot read random bytes: %s", err.Error())
+	}
+	g.mu.Lock()
+	ms := uint64(g.now().UnixMilli())
+	if ms <= g.uuidLastMs {
+		// same millisecond (or clock moved backwards): increment the counter,
+		// borrowing the next millisecond when it overflows
+		ms = g.uuidLastMs
+		g.uuidCounter++
+		if g.uuidCounter > 0x0fff {
+			ms++
+			g.uuidCounter = 0
+		}
+	} else {
+		// start from a random counter in the lower half, leaving room to increment
+		g.uuidCounter = binary.BigEndian.Uint16(id[6:8]) & 0x07ff
+	}
+	g.uuidLastMs = ms
+	counter := g.uuidCounter
+	g.mu.Unlock()
+
+	putUint48(id[0:6], ms)
+	binary.BigEndian.PutUint16(id[6:8], 0x7000|counter)
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id, nil
+}
+
+// NewUlid returns a new Ulid, greater than the previous one
+func (g *IdGenerator) NewUlid() (Ulid, error) {
+	var id Ulid
+	if _, err := rand.Read(id[6:]); err != nil {
+		return Ulid{}, fmt.Errorf("cannot read random bytes: %s", err.Error())
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := uint64(g.now().UnixMilli())
+	if ms <= g.ulidLastMs {
+		// monotonic ulid: increment the random part of the previous id
+		id = g.ulidLast
+		for i := 15; i >= 6; i-- {
+			id[i]++
+			if id[i] != 0 {
+				break
+			}
+			if i == 6 {
+				return Ulid{}, fmt.Errorf("cannot generate ulid: random part overflow in the same millisecond")
+			}
+		}
+		ms = g.ulidLastMs
+	}
+	putUint48(id[0:6], ms)
+	g.ulidLastMs = ms
+	g.ulidLast = id
+	return id, nil
+}
+
+func putUint48(b []byte, v uint64) {
+	b[0] = byte(v >> 40)
+	b[1] = byte(v >> 32)
+	b[2] = byte(v >> 24)
+	b[3] = byte(v >> 16)
+	b[4] = byte(v >> 8)
+	b[5] = byte(v)
+}
+
+func getUint48(b []byte) uint64 {
+	return uint64(b[0])<<40 | uint64(b[1])<<32 | uint64(b[2])<<24 | uint64(b[3])<<16 | uint64(b[4])<<8 | uint64(b[5])
+}
+
+// String returns the canonical 36 characters representation
+func (id UuidV7) String() string {
+	var out [36]byte
+	hex.Encode(out[0:8], id[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], id[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], id[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], id[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], id[10:])
+	return string(out[:])
+}
+
+// Time returns the creation time of the id
+func (id UuidV7) Time() time.Time {
+	return time.UnixMilli(int64(getUint48(id[0:6]))).UTC()
+}
+
+// IsZero returns true if the id has not been set
+func (id UuidV7) IsZero() bool {
+	return id == UuidV7{}
+}
+
+// ParseUuidV7 parses a version 7 UUID, with or without hyphens
+func ParseUuidV7(input string) (UuidV7, error) {
+	var id UuidV7
+	raw := strings.ReplaceAll(input, "-", "")
+	if len(raw) != 32 || (len(input) != 32 && len(input) != 36) {
+		return UuidV7{}, fmt.Errorf("cannot parse uuid %q: invalid length", input)
+	}
+	if _, err := hex.Decode(id[:], []byte(raw)); err != nil {
+		return UuidV7{}, fmt.Errorf("cannot parse uuid %q: %s", input, err.Error())
+	}
+	if id[6]>>4 != 7 || id[8]&0xc0 != 0x80 {
+		return UuidV7{}, fmt.Errorf("cannot parse uuid %q: not a version 7 uuid", input)
+	}
+	return id, nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (id UuidV7) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (id *UuidV7) UnmarshalText(text []byte) error {
+	parsed, err := ParseUuidV7(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Value implements driver.Valuer, storing the id as a 36 characters string
+func (id UuidV7) Value() (driver.Value, error) {
+	if id.IsZero() {
+		return nil, nil
+	}
+	return id.String(), nil
+}
+
+// Scan implements sql.Scanner
+func (id *UuidV7) Scan(value interface{}) error {
+	return scanSortableId(value, id.UnmarshalText, func() { *id = UuidV7{} })
+}
+
+// GormDataType sets the column type used by gorm migrations
+func (UuidV7) GormDataType() string {
+	return "char(36)"
+}
+
+// String returns the 26 characters Crockford base32 representation
+func (id Ulid) String() string {
+	var out [26]byte
+	// 130 bits encoded, the first character holds only the top 3 bits
+	hi := uint64(id[0])<<56 | uint64(id[1])<<48 | uint64(id[2])<<40 | uint64(id[3])<<32 |
+		uint64(id[4])<<24 | uint64(id[5])<<16 | uint64(id[6])<<8 | uint64(id[7])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// Time returns the creation time of the id
+func (id Ulid) Time() time.Time {
+	return time.UnixMilli(int64(getUint48(id[0:6]))).UTC()
+}
+
+// IsZero returns true if the id has not been set
+func (id Ulid) IsZero() bool {
+	return id == Ulid{}
+}
+
+// ParseUlid parses a Crockford base32 ulid, case insensitive
+func ParseUlid(input string) (Ulid, error) {
+	if len(input) != 26 {
+		return Ulid{}, fmt.Errorf("cannot parse ulid %q: invalid length", input)
+	}
+	upper := strings.ToUpper(input)
+	if upper[0] > '7' {
+		return Ulid{}, fmt.Errorf("cannot parse ulid %q: timestamp overflow", input)
+	}
+	var hi, lo uint64
+	for i := 0; i < 26; i++ {
+		value := strings.IndexByte(ulidAlphabet, upper[i])
+		if value < 0 {
+			return Ulid{}, fmt.Errorf("cannot parse ulid %q: invalid character %q", input, input[i])
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(value)
+	}
+	var id Ulid
+	for i := 7; i >= 0; i-- {
+		id[i] = byte(hi)
+		hi >>= 8
+	}
+	binary.BigEndian.PutUint64(id[8:], lo)
+	return id, nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (id Ulid) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (id *Ulid) UnmarshalText(text []byte) error {
+	parsed, err := ParseUlid(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Value implements driver.Valuer, storing the id as a 26 characters string
+func (id Ulid) Value() (driver.Value, error) {
+	if id.IsZero() {
+		return nil, nil
+	}
+	return id.String(), nil
+}
+
+// Scan implements sql.Scanner
+func (id *Ulid) Scan(value interface{}) error {
+	return scanSortableId(value, id.UnmarshalText, func() { *id = Ulid{} })
+}
+
+// GormDataType sets the column type used by gorm migrations
+func (Ulid) GormDataType() string {
+	return "char(26)"
+}
+
+func scanSortableId(value interface{}, unmarshal func([]byte) error, reset func()) error {
+	switch v := value.(type) {
+	case nil:
+		reset()
+		return nil
+	case string:
+		return unmarshal([]byte(v))
+	case []byte:
+		return unmarshal(v)
+	default:
+		return fmt.Errorf("cannot scan id from %T", value)
+	}
+}
+
+// RequestIdGeneratorUuidV7 generates request ids as UuidV7 strings,
+// to be used as AppConfig.RequestIdGenerator
+func RequestIdGeneratorUuidV7() string {
+	id, err := NewUuidV7()
+	if err != nil {
+		log.WithError(err).Errorln("cannot generate uuidv7 request id")
+		return RandomGenerateUuid(true)
+	}
+	return id.String()
+}
+
+// RequestIdGeneratorUlid generates request ids as Ulid strings,
+// to be used as AppConfig.RequestIdGenerator
+func RequestIdGeneratorUlid() string {
+	id, err := NewUlid()
+	if err != nil {
+		log.WithError(err).Errorln("cannot generate ulid request id")
+		return RandomGenerateUuid(false)[:26]
+	}
+	return id.String()
+}
@@ -0,0 +1,377 @@
+package api_common
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const IDEMPOTENCY_STATUS_PROCESSING = "PROCESSING"
+const IDEMPOTENCY_STATUS_COMPLETED = "COMPLETED"
+
+const idempotencyDefaultTtl = 24 * time.Hour
+const idempotencyDefaultProcessingTtl = 5 * time.Minute
+
+// ErrIdempotencyInProgress is returned, wrapped by RabbitDelayedError,
+// while another delivery of the same message is being processed
+var ErrIdempotencyInProgress = errors.New("message already in progress")
+
+// IdempotencyRecord tracks a processed message or request. While
+// PROCESSING, ExpiresAt bounds the processing so that a crashed instance
+// does not block the retries forever
+type IdempotencyRecord struct {
+	Key                 string `gorm:"primaryKey;size:191"`
+	Status              string `gorm:"size:16;not null"`
+	Fingerprint         string `gorm:"size:64"`
+	ResponseStatus      int
+	ResponseContentType string `gorm:"size:127"`
+	ResponseBody        []byte
+	ExpiresAt           time.Time `gorm:"index;not null"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// TableName sets the table used to persist the idempotency records
+func (IdempotencyRecord) TableName() string {
+	return "idempotency_records"
+}
+
+// IdempotencyStore persists IdempotencyRecord. Reserve must atomically
+// store record if the key is missing or expired, returning true, or
+// return the existing record and false
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, bool, error)
+	Complete(ctx context.Context, record IdempotencyRecord) error
+	Release(ctx context.Context, key string) error
+}
+
+type memoryIdempotencyEntry struct {
+	record  IdempotencyRecord
+	element *list.Element
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore kept in memory, evicting
+// the least recently used records above capacity, suitable for single
+// instance services and tests
+type MemoryIdempotencyStore struct {
+	mu       sync.Mutex
+	capacity int
+	records  map[string]*memoryIdempotencyEntry
+	lru      *list.List
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore
+func NewMemoryIdempotencyStore(capacity int) *MemoryIdempotencyStore {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	return &MemoryIdempotencyStore{capacity: capacity, records: map[string]*memoryIdempotencyEntry{}, lru: list.New()}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(_ context.Context, record IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if entry, exists := s.records[record.Key]; exists {
+		if now.Before(entry.record.ExpiresAt) {
+			s.lru.MoveToFront(entry.element)
+			return entry.record, false, nil
+		}
+		s.remove(record.Key)
+	}
+	record.CreatedAt = now
+	record.UpdatedAt = now
+	s.records[record.Key] = &memoryIdempotencyEntry{record: record, element: s.lru.PushFront(record.Key)}
+	for s.lru.Len() > s.capacity {
+		s.remove(s.lru.Back().Value.(string))
+	}
+	return record, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, record IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.records[record.Key]
+	if !exists {
+		entry = &memoryIdempotencyEntry{element: s.lru.PushFront(record.Key)}
+		s.records[record.Key] = entry
+		record.CreatedAt = time.Now()
+	} else {
+		record.CreatedAt = entry.record.CreatedAt
+		s.lru.MoveToFront(entry.element)
+	}
+	record.UpdatedAt = time.Now()
+	entry.record = record
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) remove(key string) {
+	if entry, exists := s.records[key]; exists {
+		s.lru.Remove(entry.element)
+		delete(s.records, key)
+	}
+}
+
+// GormIdempotencyStore is an IdempotencyStore persisted with gorm,
+// shared by every instance of a service
+type GormIdempotencyStore struct {
+	db *gorm.DB
+}
+
+// NewGormIdempotencyStore returns a GormIdempotencyStore, migrating the
+// idempotency_records table
+func NewGormIdempotencyStore(db *gorm.DB) (*GormIdempotencyStore, error) {
+	if errMigrate := db.AutoMigrate(&IdempotencyRecord{}); errMigrate != nil {
+		return nil, fmt.Errorf("cannot migrate idempotency records table: %s", errMigrate.Error())
+	}
+	return &GormIdempotencyStore{db: db}, nil
+}
+
+func (s *GormIdempotencyStore) Reserve(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	db := s.db.WithContext(ctx)
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("cannot reserve idempotency key %s: %s", record.Key, result.Error.Error())
+	}
+	if result.RowsAffected == 1 {
+		return record, true, nil
+	}
+	// takes over an expired record, only if nobody else did it meanwhile
+	result = db.Model(&IdempotencyRecord{}).
+		Where("`key` = ? AND expires_at < ?", record.Key, time.Now()).
+		Updates(map[string]interface{}{
+			"status":                record.Status,
+			"fingerprint":           record.Fingerprint,
+			"response_status":       0,
+			"response_content_type": "",
+			"response_body":         nil,
+			"expires_at":            record.ExpiresAt,
+		})
+	if result.Error != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("cannot reserve idempotency key %s: %s", record.Key, result.Error.Error())
+	}
+	if result.RowsAffected == 1 {
+		return record, true, nil
+	}
+	var existing IdempotencyRecord
+	if err := db.Where("`key` = ?", record.Key).Take(&existing).Error; err != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("cannot get idempotency key %s: %s", record.Key, err.Error())
+	}
+	return existing, false, nil
+}
+
+func (s *GormIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	result := s.db.WithContext(ctx).Model(&IdempotencyRecord{}).Where("`key` = ?", record.Key).
+		Updates(map[string]interface{}{
+			"status":                record.Status,
+			"fingerprint":           record.Fingerprint,
+			"response_status":       record.ResponseStatus,
+			"response_content_type": record.ResponseContentType,
+			"response_body":         record.ResponseBody,
+			"expires_at":            record.ExpiresAt,
+		})
+	if result.Error == nil && result.RowsAffected == 0 {
+		// released or taken over meanwhile: the outcome is stored anyway
+		result = s.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&record)
+	}
+	if result.Error != nil {
+		return fmt.Errorf("cannot complete idempotency key %s: %s", record.Key, result.Error.Error())
+	}
+	return nil
+}
+
+func (s *GormIdempotencyStore) Release(ctx context.Context, key string) error {
+	if err := s.db.WithContext(ctx).Where("`key` = ?", key).Delete(&IdempotencyRecord{}).Error; err != nil {
+		return fmt.Errorf("cannot release idempotency key %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// DeleteExpired removes the expired records, to be scheduled periodically
+func (s *GormIdempotencyStore) DeleteExpired(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&IdempotencyRecord{})
+	return result.RowsAffected, result.Error
+}
+
+// Idempotency skips the messages and requests already processed, as
+// recorded in Store for Ttl
+type Idempotency struct {
+	Store IdempotencyStore
+	Ttl   time.Duration
+	// ProcessingTtl is after how long a record left PROCESSING, e.g. by a
+	// crashed instance, can be taken over
+	ProcessingTtl time.Duration
+}
+
+func NewIdempotency(store IdempotencyStore, ttl time.Duration) *Idempotency {
+	if ttl <= 0 {
+		ttl = idempotencyDefaultTtl
+	}
+	return &Idempotency{Store: store, Ttl: ttl, ProcessingTtl: idempotencyDefaultProcessingTtl}
+}
+
+func (i *Idempotency) reserve(ctx context.Context, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+	return i.Store.Reserve(ctx, IdempotencyRecord{
+		Key:         key,
+		Status:      IDEMPOTENCY_STATUS_PROCESSING,
+		Fingerprint: fingerprint,
+		ExpiresAt:   time.Now().Add(i.ProcessingTtl),
+	})
+}
+
+// Handler wraps handler to process each message id once within scope,
+// usually the queue: duplicates are acknowledged without calling
+// handler, and a failed handler releases the id for the retries.
+// Messages without id are always processed
+func (i *Idempotency) Handler(scope string, handler RabbitHandler) RabbitHandler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		if delivery.MessageId == "" {
+			log.Warnf("message without id on %s, idempotency not applied", scope)
+			return handler(ctx, delivery)
+		}
+		key := scope + ":" + delivery.MessageId
+		existing, reserved, err := i.reserve(ctx, key, "")
+		if err != nil {
+			return err
+		}
+		if !reserved {
+			if existing.Status == IDEMPOTENCY_STATUS_COMPLETED {
+				log.Infof("skipping duplicate message %s on %s", delivery.MessageId, scope)
+				return nil
+			}
+			// not a failure of the message: retried later without
+			// counting an attempt, in case the first delivery fails
+			return RabbitDelayedError(ErrIdempotencyInProgress)
+		}
+		if err = handler(ctx, delivery); err != nil {
+			if errRelease := i.Store.Release(context.Background(), key); errRelease != nil {
+				log.WithError(errRelease).Errorf("cannot release message %s", delivery.MessageId)
+			}
+			return err
+		}
+		return i.Store.Complete(context.Background(), IdempotencyRecord{
+			Key:       key,
+			Status:    IDEMPOTENCY_STATUS_COMPLETED,
+			ExpiresAt: time.Now().Add(i.Ttl),
+		})
+	}
+}
+
+// idempotencyCaller identifies the caller by the actor and org of the
+// jwt, if already verified, or by the hash of the Authorization header,
+// so that callers reusing the same key never share the responses
+func idempotencyCaller(ctx *fiber.Ctx) string {
+	if actor, org, _, _, err := GetJwtUser(ctx); err == nil {
+		return "user:" + actor + "@" + org
+	}
+	if authorization := ctx.Get(fiber.HeaderAuthorization); authorization != "" {
+		return "auth:" + CryptoSha256String(authorization)
+	}
+	return "anonymous"
+}
+
+// idempotencyRequestKey returns the stored key of an Idempotency-Key,
+// hashed with the caller to bound its length
+func idempotencyRequestKey(scope string, caller string, idempotencyKey string) string {
+	hash := sha256.Sum256([]byte(caller + "\x00" + idempotencyKey))
+	return scope + ":" + hex.EncodeToString(hash[:])
+}
+
+func idempotencyFingerprint(ctx *fiber.Ctx, caller string) string {
+	hash := sha256.New()
+	hash.Write([]byte(caller))
+	hash.Write([]byte{0})
+	hash.Write([]byte(ctx.Method()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(ctx.OriginalURL()))
+	hash.Write([]byte{0})
+	hash.Write(ctx.Body())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// IdempotencyKeyMiddleware replays the stored response of the requests
+// repeating an Idempotency-Key within scope, with the
+// Idempotent-Replayed header. Keys are scoped by caller, the jwt user if
+// the middleware is registered after the jwt one, otherwise the
+// Authorization header. A key reused with a different request gets
+// 422 and a key still in progress gets 409. Responses with status 5xx are
+// not stored, so that the request can be retried. Requests without the
+// header are not affected
+func IdempotencyKeyMiddleware(idempotency *Idempotency, scope string, channel *amqp.Channel, serviceConfig MicroserviceConfiguration, source string) func(ctx *fiber.Ctx) error {
+	monitor := serviceConfig.Infrastructure.Rabbit.Monitor
+	return func(ctx *fiber.Ctx) error {
+		idempotencyKey := ctx.Get(HTTP_HEADER_IDEMPOTENCY_KEY)
+		if idempotencyKey == "" {
+			return ctx.Next()
+		}
+		if len(idempotencyKey) > 128 {
+			return Response(ctx, GetErrorResponse(API_CODE_COMMON_BAD_REQUEST, "idempotency", "idempotency key too long"),
+				400, channel, monitor.Exchange, monitor.Key, source)
+		}
+		caller := idempotencyCaller(ctx)
+		key := idempotencyRequestKey(scope, caller, idempotencyKey)
+		fingerprint := idempotencyFingerprint(ctx, caller)
+		existing, reserved, err := idempotency.reserve(ctx.UserContext(), key, fingerprint)
+		if err != nil {
+			Elog(ctx).WithError(err).Errorf("cannot reserve idempotency key")
+			return Response(ctx, GetErrorResponse(API_CODE_COMMON_INTERNAL_SERVER_ERROR, "idempotency", "cannot check idempotency key"),
+				500, channel, monitor.Exchange, monitor.Key, source)
+		}
+		if !reserved {
+			if existing.Fingerprint != fingerprint {
+				return Response(ctx, GetErrorResponse(API_CODE_COMMON_BAD_REQUEST, "idempotency", "idempotency key reused with a different request"),
+					422, channel, monitor.Exchange, monitor.Key, source)
+			}
+			if existing.Status != IDEMPOTENCY_STATUS_COMPLETED {
+				return Response(ctx, GetErrorResponse(API_CODE_COMMON_CONFLICT, "idempotency", "request with the same idempotency key in progress"),
+					409, channel, monitor.Exchange, monitor.Key, source)
+			}
+			Elog(ctx).Infof("replaying response of idempotency key %s", idempotencyKey)
+			ctx.Set(HTTP_HEADER_IDEMPOTENT_REPLAYED, "true")
+			if existing.ResponseContentType != "" {
+				ctx.Set(fiber.HeaderContentType, existing.ResponseContentType)
+			}
+			return ctx.Status(existing.ResponseStatus).Send(existing.ResponseBody)
+		}
+
+		errNext := ctx.Next()
+		status := ctx.Response().StatusCode()
+		if errNext != nil || status >= 500 {
+			if errRelease := idempotency.Store.Release(context.Background(), key); errRelease != nil {
+				Elog(ctx).WithError(errRelease).Errorf("cannot release idempotency key")
+			}
+			return errNext
+		}
+		errComplete := idempotency.Store.Complete(context.Background(), IdempotencyRecord{
+			Key:                 key,
+			Status:              IDEMPOTENCY_STATUS_COMPLETED,
+			Fingerprint:         fingerprint,
+			ResponseStatus:      status,
+			ResponseContentType: string(ctx.Response().Header.ContentType()),
+			ResponseBody:        append([]byte{}, ctx.Response().Body()...),
+			ExpiresAt:           time.Now().Add(idempotency.Ttl),
+		})
+		if errComplete != nil {
+			Elog(ctx).WithError(errComplete).Errorf("cannot store idempotent response")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package api_common
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestIdempotencyKeyMiddlewareScopesKeysByCaller(t *testing.T) {
+	idempotency := NewIdempotency(NewMemoryIdempotencyStore(100), 0)
+	app := fiber.New()
+	app.Use(RequestIdMiddleware(RequestIdConfig{}))
+	app.Use(IdempotencyKeyMiddleware(idempotency, "orders", nil, MicroserviceConfiguration{}, "test"))
+	calls := 0
+	app.Post("/orders", func(c *fiber.Ctx) error {
+		calls++
+		return c.Status(201).JSON(fiber.Map{"owner": c.Get(fiber.HeaderAuthorization)})
+	})
+
+	send := func(authorization string) (string, string) {
+		request := httptest.NewRequest("POST", "/orders", strings.NewReader(`{"item":1}`))
+		request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		request.Header.Set(fiber.HeaderAuthorization, authorization)
+		request.Header.Set(HTTP_HEADER_IDEMPOTENCY_KEY, "same-key")
+		response, err := app.Test(request)
+		if err != nil {
+			t.Fatalf("cannot send request: %s", err.Error())
+		}
+		body, _ := io.ReadAll(response.Body)
+		return string(body), response.Header.Get(HTTP_HEADER_IDEMPOTENT_REPLAYED)
+	}
+
+	first, _ := send("Bearer alice")
+	second, replayed := send("Bearer bob")
+	if replayed != "" || strings.Contains(second, "alice") || !strings.Contains(second, "bob") {
+		t.Errorf("expected a new response for the second caller, got %s (replayed %q)", second, replayed)
+	}
+	again, replayed := send("Bearer alice")
+	if replayed != "true" || again != first {
+		t.Errorf("expected the replay of %s for the first caller, got %s (replayed %q)", first, again, replayed)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 handler calls, got %d", calls)
+	}
+}
@@ -14,14 +14,19 @@ func Elog(c *fiber.Ctx) *log.Entry {
 	actor, org, role, hierarchy, _ := GetJwtUser(c)
 	ips := append([]string{c.IP()}, c.IPs()...)
 	reqId := c.Locals(CTX_REQUESTID).(string)
-	return log.WithFields(log.Fields{
+	fields := log.Fields{
 		"actor":     actor,
 		"org":       org,
 		"role":      role,
 		"hierarchy": hierarchy,
 		"ips":       ips,
 		"uuid":      reqId,
-	})
+	}
+	if tc, ok := TraceContextFromContext(c.UserContext()); ok {
+		fields["trace_id"] = tc.TraceIdString()
+		fields["span_id"] = tc.SpanIdString()
+	}
+	return log.WithFields(fields)
 }
 
 // GetJwtFromContext returns the jwt object, given the fiber context
@@ -78,7 +83,8 @@ func RequiresRefreshToken(serviceConfig MicroserviceConfiguration, channel *amqp
 		var response interface{}
 		token, err := GetJwtFromContext(ctx)
 		if err != nil {
-			Elog(ctx).WithError(err).Panic("cannot get jwt from context")
+			Elog(ctx).WithError(err).Errorf("cannot get jwt from context")
+			RecordAuthFailure("refresh_token", "missing_token")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires refresh token", err.Error())
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -90,8 +96,9 @@ func RequiresRefreshToken(serviceConfig MicroserviceConfiguration, channel *amqp
 		}
 		claims := token.Claims.(jwt.MapClaims)
 
-		if len(claims) != len(serviceConfig.Application.Jwt.Api.RefreshToken.Claims) {
+		if jwtClaimsCount(claims) != len(serviceConfig.Application.Jwt.Api.RefreshToken.Claims) {
 			Elog(ctx).Errorf("invalid token provided")
+			RecordAuthFailure("refresh_token", "invalid_claims")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires refresh token", "invalid token provided")
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -102,8 +109,9 @@ func RequiresRefreshToken(serviceConfig MicroserviceConfiguration, channel *amqp
 			return ctx.Status(401).JSON(response)
 		}
 		for i, _ := range claims {
-			if !StringArrayContains(serviceConfig.Application.Jwt.Api.RefreshToken.Claims, i) {
+			if i != JWT_CLAIM_MFA && !StringArrayContains(serviceConfig.Application.Jwt.Api.RefreshToken.Claims, i) {
 				Elog(ctx).Errorf("invalid token provided")
+				RecordAuthFailure("refresh_token", "invalid_claims")
 				response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires refresh token", "invalid token provided")
 				err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 				if err != nil {
@@ -123,7 +131,8 @@ func RequiresAccessToken(applicationClaims []string, channel *amqp.Channel, serv
 		var response interface{}
 		token, err := GetJwtFromContext(ctx)
 		if err != nil {
-			Elog(ctx).WithError(err).Panic("cannot get jwt from context")
+			Elog(ctx).WithError(err).Errorf("cannot get jwt from context")
+			RecordAuthFailure("access_token", "missing_token")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires access token", err.Error())
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -135,8 +144,9 @@ func RequiresAccessToken(applicationClaims []string, channel *amqp.Channel, serv
 		}
 		claims := token.Claims.(jwt.MapClaims)
 
-		if len(claims) != len(applicationClaims) {
+		if jwtClaimsCount(claims) != len(applicationClaims) {
 			Elog(ctx).Errorf("invalid token provided")
+			RecordAuthFailure("access_token", "invalid_claims")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires access token", "invalid token provided")
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -147,8 +157,9 @@ func RequiresAccessToken(applicationClaims []string, channel *amqp.Channel, serv
 			return ctx.Status(401).JSON(response)
 		}
 		for i, _ := range claims {
-			if !StringArrayContains(applicationClaims, i) {
+			if i != JWT_CLAIM_MFA && !StringArrayContains(applicationClaims, i) {
 				Elog(ctx).Errorf("invalid token provided")
+				RecordAuthFailure("access_token", "invalid_claims")
 				response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires access token", "invalid token provided")
 				err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 				if err != nil {
@@ -169,7 +180,8 @@ func RequiresHierarchy(hierarchies []int, channel *amqp.Channel, serviceConfig M
 		var response interface{}
 		token, err := GetJwtFromContext(ctx)
 		if err != nil {
-			Elog(ctx).WithError(err).Panic("cannot get jwt from context")
+			Elog(ctx).WithError(err).Errorf("cannot get jwt from context")
+			RecordAuthFailure("hierarchy", "missing_token")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires hierarchy", err.Error())
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -183,6 +195,7 @@ func RequiresHierarchy(hierarchies []int, channel *amqp.Channel, serviceConfig M
 		jwtHierarchy := int(claims["hierarchy"].(float64))
 		if !IntArrayContains(hierarchies, jwtHierarchy) {
 			Elog(ctx).Errorf("Unauthorized user hierarchy: %d, with role %s", jwtHierarchy, claims["role"].(string))
+			RecordAuthFailure("hierarchy", "hierarchy_not_allowed")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires hierarchy", fmt.Sprintf("Unauthorized user hierarchy: %d, with role %s", jwtHierarchy, claims["role"].(string)))
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -201,7 +214,8 @@ func RequiresFirstLogin(isRequired bool, channel *amqp.Channel, serviceConfig Mi
 		var response interface{}
 		token, err := GetJwtFromContext(ctx)
 		if err != nil {
-			Elog(ctx).WithError(err).Panic("cannot get jwt from context")
+			Elog(ctx).WithError(err).Errorf("cannot get jwt from context")
+			RecordAuthFailure("first_login", "missing_token")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires first login", "cannot get jwt from context")
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -215,7 +229,8 @@ func RequiresFirstLogin(isRequired bool, channel *amqp.Channel, serviceConfig Mi
 		var firstLogin bool
 		firstLogin, err = strconv.ParseBool(claims["first_login"].(string))
 		if err != nil {
-			Elog(ctx).WithError(err).Panic("cannot get first_login claim")
+			Elog(ctx).WithError(err).Errorf("cannot get first_login claim")
+			RecordAuthFailure("first_login", "invalid_first_login_claim")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires first login", "cannot get first_login claim")
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -227,6 +242,7 @@ func RequiresFirstLogin(isRequired bool, channel *amqp.Channel, serviceConfig Mi
 		}
 		if firstLogin != isRequired {
 			Elog(ctx).Errorf("invalid token provided")
+			RecordAuthFailure("first_login", "invalid_claims")
 			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires first login", "invalid token provided")
 			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
 			if err != nil {
@@ -240,3 +256,70 @@ func RequiresFirstLogin(isRequired bool, channel *amqp.Channel, serviceConfig Mi
 		return ctx.Next()
 	}
 }
+
+// jwtClaimsCount returns the number of claims, excluding JWT_CLAIM_MFA
+// which is added to the configured claims by JwtSetMfaClaim
+func jwtClaimsCount(claims jwt.MapClaims) int {
+	if _, ok := claims[JWT_CLAIM_MFA]; ok {
+		return len(claims) - 1
+	}
+	return len(claims)
+}
+
+// JwtSetMfaClaim sets the JWT_CLAIM_MFA claim in the claims of a token
+// issued after the two-factor authentication, and returns them
+func JwtSetMfaClaim(claims jwt.MapClaims) jwt.MapClaims {
+	if claims == nil {
+		claims = jwt.MapClaims{}
+	}
+	claims[JWT_CLAIM_MFA] = true
+	return claims
+}
+
+// JwtHasCompletedMfa returns true if the token carries the JWT_CLAIM_MFA claim
+func JwtHasCompletedMfa(token *jwt.Token) bool {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	switch mfa := claims[JWT_CLAIM_MFA].(type) {
+	case bool:
+		return mfa
+	case string:
+		return ParseBool(mfa, false)
+	default:
+		return false
+	}
+}
+
+func RequiresMfa(channel *amqp.Channel, serviceConfig MicroserviceConfiguration, source string) func(ctx *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		var response interface{}
+		token, err := GetJwtFromContext(ctx)
+		if err != nil {
+			Elog(ctx).WithError(err).Errorf("cannot get jwt from context")
+			RecordAuthFailure("mfa", "missing_token")
+			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires mfa", err.Error())
+			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
+			if err != nil {
+				Elog(ctx).WithError(err).Errorf("cannot send message to monitor")
+			} else {
+				Elog(ctx).Infof("successfully sent message to monitor")
+			}
+			return ctx.Status(401).JSON(response)
+		}
+		if !JwtHasCompletedMfa(token) {
+			Elog(ctx).Errorf("two-factor authentication not completed")
+			RecordAuthFailure("mfa", "mfa_not_completed")
+			response = GetErrorResponse(API_CODE_COMMON_UNAUTHORIZED, "requires mfa", "two-factor authentication not completed")
+			err = PublishToMonitor(response, ctx, 401, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source, "rest", nil, nil)
+			if err != nil {
+				Elog(ctx).WithError(err).Errorf("cannot send message to monitor")
+			} else {
+				Elog(ctx).Infof("successfully sent message to monitor")
+			}
+			return ctx.Status(401).JSON(response)
+		}
+		return ctx.Next()
+	}
+}
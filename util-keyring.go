@@ -0,0 +1,337 @@
+package api_common
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CRYPTO_ENVELOPE_VERSION is the current version of the ciphertext
+// envelope, whose header is authenticated together with the ciphertext
+const CRYPTO_ENVELOPE_VERSION = "v1"
+
+// CRYPTO_ALGORITHM_AES256GCM identifies AES-256 in GCM mode inside the envelope
+const CRYPTO_ALGORITHM_AES256GCM = "A256GCM"
+
+// CRYPTO_LEGACY_KID is the key id assigned to the key read from
+// Database.EncryptionKeyFilepath, used for legacy hex ciphertexts
+const CRYPTO_LEGACY_KID = "legacy"
+
+const cryptoEnvelopeSeparator = ":"
+
+var cryptoKidRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// CryptoEnvelope is the versioned representation of an encrypted value.
+// Its string form is version:kid:algorithm:hex(nonce):hex(ciphertext)
+type CryptoEnvelope struct {
+	Version    string
+	KeyId      string
+	Algorithm  string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// String encodes the envelope in its textual form
+func (e CryptoEnvelope) String() string {
+	return strings.Join([]string{
+		e.Version,
+		e.KeyId,
+		e.Algorithm,
+		hex.EncodeToString(e.Nonce),
+		hex.EncodeToString(e.Ciphertext),
+	}, cryptoEnvelopeSeparator)
+}
+
+// AAD returns the additional authenticated data sealing the envelope:
+// the header (version, key id and algorithm) followed by aad, so that
+// the header cannot be altered without failing the decryption
+func (e CryptoEnvelope) AAD(aad []byte) []byte {
+	return CryptoAAD(e.Version, e.KeyId, e.Algorithm, string(aad))
+}
+
+// CryptoIsLegacyCiphertext returns true if the given value has been
+// produced by CryptoEncryptText, that is a bare hex nonce+ciphertext
+func CryptoIsLegacyCiphertext(encryptedText string) bool {
+	return !strings.Contains(encryptedText, cryptoEnvelopeSeparator)
+}
+
+// CryptoParseEnvelope parses the textual form of an envelope
+func CryptoParseEnvelope(encryptedText string) (CryptoEnvelope, error) {
+	parts := strings.Split(encryptedText, cryptoEnvelopeSeparator)
+	if len(parts) != 5 {
+		return CryptoEnvelope{}, fmt.Errorf("cannot parse envelope: expected 5 parts, found %d", len(parts))
+	}
+	if parts[0] != CRYPTO_ENVELOPE_VERSION {
+		return CryptoEnvelope{}, fmt.Errorf("cannot parse envelope: unsupported version %s", parts[0])
+	}
+	if !cryptoKidRegex.MatchString(parts[1]) {
+		return CryptoEnvelope{}, fmt.Errorf("cannot parse envelope: invalid key id")
+	}
+	nonce, errNonce := hex.DecodeString(parts[3])
+	if errNonce != nil {
+		return CryptoEnvelope{}, fmt.Errorf("cannot hex decode envelope nonce: %s", errNonce.Error())
+	}
+	ciphertext, errCiphertext := hex.DecodeString(parts[4])
+	if errCiphertext != nil {
+		return CryptoEnvelope{}, fmt.Errorf("cannot hex decode envelope ciphertext: %s", errCiphertext.Error())
+	}
+	return CryptoEnvelope{
+		Version:    parts[0],
+		KeyId:      parts[1],
+		Algorithm:  parts[2],
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// CryptoKeyring holds multiple encryption keys identified by key id.
+// New values are always encrypted with the primary key, while every key
+// in the ring can be used for decryption
+type CryptoKeyring struct {
+	mu        sync.RWMutex
+	keys      map[string]*Cipher
+	primary   string
+	legacyKid string
+}
+
+// NewCryptoKeyring returns an empty keyring
+func NewCryptoKeyring() *CryptoKeyring {
+	return &CryptoKeyring{keys: map[string]*Cipher{}}
+}
+
+// AddKey adds a 32 bytes key to the keyring. The first key added
+// becomes the primary key until SetPrimary is called
+func (k *CryptoKeyring) AddKey(kid string, key []byte) error {
+	if !cryptoKidRegex.MatchString(kid) {
+		return fmt.Errorf("cannot add key: invalid key id %q", kid)
+	}
+	aes256Cipher, errNewCipher := NewCipher(key)
+	if errNewCipher != nil {
+		return errNewCipher
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[kid]; exists {
+		return fmt.Errorf("cannot add key: key id %s already in keyring", kid)
+	}
+	k.keys[kid] = aes256Cipher
+	if k.primary == "" {
+		k.primary = kid
+	}
+	return nil
+}
+
+// SetPrimary selects the key used to encrypt new values
+func (k *CryptoKeyring) SetPrimary(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[kid]; !exists {
+		return fmt.Errorf("cannot set primary key: key id %s not in keyring", kid)
+	}
+	k.primary = kid
+	return nil
+}
+
+// SetLegacy selects the key used to decrypt legacy hex ciphertexts
+func (k *CryptoKeyring) SetLegacy(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[kid]; !exists {
+		return fmt.Errorf("cannot set legacy key: key id %s not in keyring", kid)
+	}
+	k.legacyKid = kid
+	return nil
+}
+
+// Primary returns the id of the primary key
+func (k *CryptoKeyring) Primary() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary
+}
+
+func (k *CryptoKeyring) getKey(kid string) (*Cipher, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aes256Cipher, exists := k.keys[kid]
+	if !exists {
+		return nil, fmt.Errorf("cannot find key id %s in keyring", kid)
+	}
+	return aes256Cipher, nil
+}
+
+// Encrypt encrypts the given string with the primary key and returns
+// the textual envelope
+func (k *CryptoKeyring) Encrypt(plainText string) (string, error) {
+	return k.EncryptWithAAD(plainText, nil)
+}
+
+// EncryptWithAAD encrypts the given string with the primary key binding
+// it to aad (see CryptoAAD) and returns the textual envelope
+func (k *CryptoKeyring) EncryptWithAAD(plainText string, aad []byte) (string, error) {
+	now := time.Now()
+	kid := k.Primary()
+	if kid == "" {
+		return "", fmt.Errorf("cannot encrypt text: keyring is empty")
+	}
+	aes256Cipher, errGetKey := k.getKey(kid)
+	if errGetKey != nil {
+		return "", errGetKey
+	}
+	envelope := CryptoEnvelope{
+		Version:   CRYPTO_ENVELOPE_VERSION,
+		KeyId:     kid,
+		Algorithm: CRYPTO_ALGORITHM_AES256GCM,
+	}
+	sealed, errSeal := aes256Cipher.Seal([]byte(plainText), envelope.AAD(aad))
+	if errSeal != nil {
+		return "", errSeal
+	}
+	envelope.Nonce = sealed[:aes256Cipher.NonceSize()]
+	envelope.Ciphertext = sealed[aes256Cipher.NonceSize():]
+	log.Tracef("completed CryptoKeyring.Encrypt operation in %s", time.Since(now))
+	return envelope.String(), nil
+}
+
+// Decrypt decrypts an envelope produced by Encrypt or a legacy hex
+// ciphertext produced by CryptoEncryptText
+func (k *CryptoKeyring) Decrypt(encryptedText string) (string, error) {
+	return k.DecryptWithAAD(encryptedText, nil)
+}
+
+// DecryptWithAAD decrypts an envelope produced by EncryptWithAAD, or a
+// legacy hex ciphertext, with the same aad
+func (k *CryptoKeyring) DecryptWithAAD(encryptedText string, aad []byte) (string, error) {
+	now := time.Now()
+	if CryptoIsLegacyCiphertext(encryptedText) {
+		k.mu.RLock()
+		legacyKid := k.legacyKid
+		k.mu.RUnlock()
+		if legacyKid == "" {
+			return "", fmt.Errorf("cannot decrypt legacy text: no legacy key in keyring")
+		}
+		aes256Cipher, errGetKey := k.getKey(legacyKid)
+		if errGetKey != nil {
+			return "", errGetKey
+		}
+		plainText, errOpen := aes256Cipher.OpenString(encryptedText, aad)
+		if errOpen != nil {
+			return "", errOpen
+		}
+		log.Tracef("completed CryptoKeyring.Decrypt legacy operation in %s", time.Since(now))
+		return plainText, nil
+	}
+	envelope, errParse := CryptoParseEnvelope(encryptedText)
+	if errParse != nil {
+		return "", errParse
+	}
+	if envelope.Algorithm != CRYPTO_ALGORITHM_AES256GCM {
+		return "", fmt.Errorf("cannot decrypt text: unsupported algorithm %s", envelope.Algorithm)
+	}
+	aes256Cipher, errGetKey := k.getKey(envelope.KeyId)
+	if errGetKey != nil {
+		return "", errGetKey
+	}
+	if len(envelope.Nonce) != aes256Cipher.NonceSize() {
+		return "", fmt.Errorf("cannot decrypt text with invalid nonce length")
+	}
+	plainText, errOpen := aes256Cipher.Open(append(envelope.Nonce, envelope.Ciphertext...), envelope.AAD(aad))
+	if errOpen != nil {
+		return "", errOpen
+	}
+	log.Tracef("completed CryptoKeyring.Decrypt operation in %s", time.Since(now))
+	return string(plainText), nil
+}
+
+// NeedsReEncryption returns true if the given value is a legacy
+// ciphertext or has not been encrypted with the primary key
+func (k *CryptoKeyring) NeedsReEncryption(encryptedText string) bool {
+	if CryptoIsLegacyCiphertext(encryptedText) {
+		return true
+	}
+	envelope, errParse := CryptoParseEnvelope(encryptedText)
+	if errParse != nil {
+		return true
+	}
+	return envelope.KeyId != k.Primary() || envelope.Algorithm != CRYPTO_ALGORITHM_AES256GCM
+}
+
+// ReEncrypt decrypts the given value and encrypts it again with the
+// primary key. The returned bool is false if no re-encryption was needed
+func (k *CryptoKeyring) ReEncrypt(encryptedText string) (string, bool, error) {
+	return k.ReEncryptWithAAD(encryptedText, nil)
+}
+
+// ReEncryptWithAAD is ReEncrypt for values encrypted with EncryptWithAAD:
+// the value is decrypted and encrypted again with the same aad
+func (k *CryptoKeyring) ReEncryptWithAAD(encryptedText string, aad []byte) (string, bool, error) {
+	if !k.NeedsReEncryption(encryptedText) {
+		return encryptedText, false, nil
+	}
+	plainText, errDecrypt := k.DecryptWithAAD(encryptedText, aad)
+	if errDecrypt != nil {
+		return "", false, errDecrypt
+	}
+	reEncrypted, errEncrypt := k.EncryptWithAAD(plainText, aad)
+	if errEncrypt != nil {
+		return "", false, errEncrypt
+	}
+	return reEncrypted, true, nil
+}
+
+// GetKeyringFromConfig builds a keyring with the keys listed in
+// Database.EncryptionKeys. The key in Database.EncryptionKeyFilepath,
+// if set, is added with id CRYPTO_LEGACY_KID and used for legacy values
+func GetKeyringFromConfig(serviceConfig *MicroserviceConfiguration) (*CryptoKeyring, error) {
+	log.Traceln("calling GetKeyringFromConfig method")
+	if serviceConfig == nil {
+		return nil, fmt.Errorf("cannot get keyring because service configuration is not initialized")
+	}
+	keyring := NewCryptoKeyring()
+	dbConfig := serviceConfig.Infrastructure.Database
+	if dbConfig.EncryptionKeyFilepath != "" {
+		legacyKey, errGetSecret := GetSecretString(dbConfig.EncryptionKeyFilepath)
+		if errGetSecret != nil {
+			return nil, errGetSecret
+		}
+		if errAdd := keyring.AddKey(CRYPTO_LEGACY_KID, []byte(legacyKey)); errAdd != nil {
+			return nil, errAdd
+		}
+		if errSet := keyring.SetLegacy(CRYPTO_LEGACY_KID); errSet != nil {
+			return nil, errSet
+		}
+	}
+	primary := ""
+	for _, encryptionKey := range dbConfig.EncryptionKeys {
+		key, errGetSecret := GetSecretString(encryptionKey.Filepath)
+		if errGetSecret != nil {
+			return nil, errGetSecret
+		}
+		if errAdd := keyring.AddKey(encryptionKey.Kid, []byte(key)); errAdd != nil {
+			return nil, errAdd
+		}
+		if encryptionKey.Primary {
+			if primary != "" {
+				return nil, fmt.Errorf("cannot get keyring: both %s and %s are marked as primary", primary, encryptionKey.Kid)
+			}
+			primary = encryptionKey.Kid
+		}
+	}
+	if primary == "" && len(dbConfig.EncryptionKeys) > 0 {
+		primary = dbConfig.EncryptionKeys[len(dbConfig.EncryptionKeys)-1].Kid
+	}
+	if primary != "" {
+		if errSet := keyring.SetPrimary(primary); errSet != nil {
+			return nil, errSet
+		}
+	}
+	if keyring.Primary() == "" {
+		return nil, fmt.Errorf("cannot get keyring: no encryption key configured")
+	}
+	return keyring, nil
+}
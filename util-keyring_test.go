@@ -0,0 +1,66 @@
+package api_common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCryptoKeyringReEncryptWithAAD(t *testing.T) {
+	keyring := NewCryptoKeyring()
+	if err := keyring.AddKey("k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("cannot add key: %s", err.Error())
+	}
+	if err := keyring.AddKey("k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatalf("cannot add key: %s", err.Error())
+	}
+	aad := CryptoAAD("users", "email", "42")
+	encrypted, err := keyring.EncryptWithAAD("a@b.c", aad)
+	if err != nil {
+		t.Fatalf("cannot encrypt: %s", err.Error())
+	}
+	if _, err = keyring.Decrypt(encrypted); err == nil {
+		t.Errorf("expected an error decrypting without the aad")
+	}
+	if err = keyring.SetPrimary("k2"); err != nil {
+		t.Fatalf("cannot set primary: %s", err.Error())
+	}
+	if _, _, err = keyring.ReEncrypt(encrypted); err == nil {
+		t.Errorf("expected an error re-encrypting without the aad")
+	}
+	reEncrypted, changed, err := keyring.ReEncryptWithAAD(encrypted, aad)
+	if err != nil || !changed {
+		t.Fatalf("expected the value to be re-encrypted (%v)", err)
+	}
+	if keyring.NeedsReEncryption(reEncrypted) {
+		t.Errorf("expected the value to be encrypted with the primary key")
+	}
+	plainText, err := keyring.DecryptWithAAD(reEncrypted, aad)
+	if err != nil || plainText != "a@b.c" {
+		t.Errorf("expected a@b.c, got %q (%v)", plainText, err)
+	}
+	if _, changed, _ = keyring.ReEncryptWithAAD(reEncrypted, aad); changed {
+		t.Errorf("expected no re-encryption with the primary key")
+	}
+}
+
+func TestCryptoEnvelopeHeaderIsAuthenticated(t *testing.T) {
+	keyring := NewCryptoKeyring()
+	// the same key under two ids: only the authenticated header differs
+	for _, kid := range []string{"k1", "k2"} {
+		if err := keyring.AddKey(kid, bytes.Repeat([]byte{1}, 32)); err != nil {
+			t.Fatalf("cannot add key: %s", err.Error())
+		}
+	}
+	encrypted, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("cannot encrypt: %s", err.Error())
+	}
+	envelope, err := CryptoParseEnvelope(encrypted)
+	if err != nil {
+		t.Fatalf("cannot parse envelope: %s", err.Error())
+	}
+	envelope.KeyId = "k2"
+	if _, err = keyring.Decrypt(envelope.String()); err == nil {
+		t.Errorf("expected an error decrypting a modified header")
+	}
+}
@@ -0,0 +1,244 @@
+package api_common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+)
+
+const lifecycleDefaultTimeout = 30 * time.Second
+const lifecycleDefaultHookTimeout = 10 * time.Second
+
+type lifecycleHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Lifecycle orchestrates the graceful shutdown of a service. On
+// SIGTERM/SIGINT (or Shutdown) it runs phases 1-3 within Timeout:
+//  1. readiness is set to false and DrainDelay is waited, so that the
+//     load balancer stops sending new requests
+//  2. the fiber apps stop accepting connections and drain in-flight requests
+//  3. the lifecycle context is cancelled and the workers started with Go
+//     (e.g. Rabbit consumers) are waited for
+//  4. the shutdown hooks run in reverse registration order, so resources
+//     registered first (e.g. the DB pool) are closed last. Every hook has
+//     its own HookTimeout, so hooks run even if the previous phases used
+//     the whole Timeout
+type Lifecycle struct {
+	Timeout     time.Duration
+	HookTimeout time.Duration
+	DrainDelay  time.Duration
+
+	mu       sync.Mutex
+	health   *HealthRegistry
+	apps     []*fiber.App
+	hooks    []lifecycleHook
+	workers  sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	once     sync.Once
+	shutdown chan struct{}
+	err      error
+}
+
+// NewLifecycle returns a Lifecycle flipping the readiness of health
+// (may be nil) at shutdown
+func NewLifecycle(health *HealthRegistry) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		Timeout:     lifecycleDefaultTimeout,
+		HookTimeout: lifecycleDefaultHookTimeout,
+		health:      health,
+		ctx:         ctx,
+		cancel:      cancel,
+		shutdown:    make(chan struct{}),
+	}
+}
+
+// Context returns a context cancelled when the shutdown reaches the
+// workers phase
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Done returns a channel closed when the shutdown is completed
+func (l *Lifecycle) Done() <-chan struct{} {
+	return l.shutdown
+}
+
+// AddFiberApp registers an app drained in the HTTP phase
+func (l *Lifecycle) AddFiberApp(app *fiber.App) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.apps = append(l.apps, app)
+}
+
+// Go starts a worker waited for during shutdown. fn must return once
+// ctx is cancelled, after completing the message it is handling
+func (l *Lifecycle) Go(name string, fn func(ctx context.Context)) {
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Errorf("worker %s panicked: %v", name, recovered)
+			}
+		}()
+		fn(l.ctx)
+		log.Debugf("worker %s stopped", name)
+	}()
+}
+
+// OnShutdown registers a hook run in the last phase, in reverse
+// registration order
+func (l *Lifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, lifecycleHook{name: name, fn: fn})
+}
+
+// AddDB registers a hook closing the connection pool of db
+func (l *Lifecycle) AddDB(db *gorm.DB) {
+	l.OnShutdown("database", func(ctx context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.Close()
+	})
+}
+
+// AddRabbitConnection registers a hook closing the amqp connection
+func (l *Lifecycle) AddRabbitConnection(conn *amqp.Connection) {
+	l.OnShutdown("rabbit connection", func(ctx context.Context) error {
+		if conn.IsClosed() {
+			return nil
+		}
+		return conn.Close()
+	})
+}
+
+// AddRabbitChannel registers a hook closing the amqp channel
+func (l *Lifecycle) AddRabbitChannel(channel *amqp.Channel) {
+	l.OnShutdown("rabbit channel", func(ctx context.Context) error {
+		err := channel.Close()
+		if err == amqp.ErrClosed {
+			return nil
+		}
+		return err
+	})
+}
+
+// WaitForSignal blocks until SIGTERM or SIGINT is received, then runs
+// the shutdown and returns its error
+func (l *Lifecycle) WaitForSignal() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	select {
+	case received := <-signals:
+		log.Infof("received signal %s, shutting down", received)
+	case <-l.shutdown:
+		return l.err
+	}
+	return l.Shutdown()
+}
+
+// Shutdown runs the shutdown phases once; further calls wait for the
+// first one and return its error
+func (l *Lifecycle) Shutdown() error {
+	l.once.Do(func() {
+		l.err = l.run()
+		close(l.shutdown)
+	})
+	<-l.shutdown
+	return l.err
+}
+
+func (l *Lifecycle) run() error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), l.Timeout)
+	defer cancel()
+	var errs []string
+
+	if l.health != nil {
+		l.health.SetReady(false)
+	}
+	if l.DrainDelay > 0 {
+		log.Infof("readiness set to false, waiting %s before draining", l.DrainDelay)
+		select {
+		case <-time.After(l.DrainDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	l.mu.Lock()
+	apps := append([]*fiber.App{}, l.apps...)
+	hooks := append([]lifecycleHook{}, l.hooks...)
+	l.mu.Unlock()
+
+	for _, app := range apps {
+		if err := lifecycleWithContext(ctx, app.Shutdown); err != nil {
+			errs = append(errs, fmt.Sprintf("http: %s", err.Error()))
+		}
+	}
+	log.Infoln("http servers stopped")
+
+	l.cancel()
+	workersDone := make(chan struct{})
+	go func() {
+		l.workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+		log.Infoln("workers stopped")
+	case <-ctx.Done():
+		errs = append(errs, "workers: timed out waiting for in-flight handlers")
+	}
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		hookCtx, hookCancel := context.WithTimeout(context.Background(), TernaryOperator(l.HookTimeout > 0, l.HookTimeout, lifecycleDefaultHookTimeout).(time.Duration))
+		err := lifecycleWithContext(hookCtx, func() error { return hook.fn(hookCtx) })
+		hookCancel()
+		if err != nil {
+			log.WithError(err).Errorf("shutdown hook %s failed", hook.name)
+			errs = append(errs, fmt.Sprintf("%s: %s", hook.name, err.Error()))
+		} else {
+			log.Debugf("shutdown hook %s completed", hook.name)
+		}
+	}
+
+	log.Infof("shutdown completed in %s", time.Since(start))
+	if len(errs) > 0 {
+		return fmt.Errorf("shutdown completed with errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// lifecycleWithContext runs fn returning early if ctx expires, since
+// calls like fiber.App.Shutdown do not accept a deadline
+func lifecycleWithContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out: %s", ctx.Err().Error())
+	}
+}
@@ -3,12 +3,15 @@ package api_common
 import (
 	"os"
 	"strings"
+	"sync"
 
 	"go.elastic.co/ecslogrus"
 
 	"github.com/sirupsen/logrus"
 )
 
+var redactionHookOnce sync.Once
+
 // InitLogger initializes settings for logrus logger
 func InitLogger(loglevel string) {
 
@@ -20,6 +23,10 @@ func InitLogger(loglevel string) {
 	}
 	logrus.SetFormatter(&formatter)
 	logrus.SetReportCaller(true)
+	// InitLogger may be called more than once, the hook must be added once
+	redactionHookOnce.Do(func() {
+		logrus.AddHook(RedactionHook{})
+	})
 	switch strings.ToUpper(os.Getenv(loglevel)) {
 	case "PANIC":
 		logrus.SetLevel(logrus.PanicLevel)
@@ -0,0 +1,493 @@
+package api_common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoginAttempt keeps the failed login counters of a user or an ip
+type LoginAttempt struct {
+	Key           string `gorm:"primaryKey;size:191"`
+	Failures      int    `gorm:"not null;default:0"`
+	Lockouts      int    `gorm:"not null;default:0"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// TableName sets the table used to persist the login attempts
+func (LoginAttempt) TableName() string {
+	return "login_attempts"
+}
+
+// LoginAttemptStore persists LoginAttempt records. Update must apply fn
+// atomically, so that concurrent failures are never lost
+type LoginAttemptStore interface {
+	Get(ctx context.Context, key string) (LoginAttempt, error)
+	Update(ctx context.Context, key string, fn func(attempt *LoginAttempt)) (LoginAttempt, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryLoginAttemptStore is a LoginAttemptStore kept in memory,
+// suitable for single instance services and tests
+type MemoryLoginAttemptStore struct {
+	mu        sync.Mutex
+	attempts  map[string]LoginAttempt
+	retention time.Duration
+	updates   int
+}
+
+// NewMemoryLoginAttemptStore returns an empty MemoryLoginAttemptStore.
+// Unlocked records without failures for retention are periodically removed
+func NewMemoryLoginAttemptStore(retention time.Duration) *MemoryLoginAttemptStore {
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+	return &MemoryLoginAttemptStore{attempts: map[string]LoginAttempt{}, retention: retention}
+}
+
+func (s *MemoryLoginAttemptStore) Get(_ context.Context, key string) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt, exists := s.attempts[key]
+	if !exists {
+		return LoginAttempt{Key: key}, nil
+	}
+	return attempt, nil
+}
+
+func (s *MemoryLoginAttemptStore) Update(_ context.Context, key string, fn func(attempt *LoginAttempt)) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt, exists := s.attempts[key]
+	if !exists {
+		attempt = LoginAttempt{Key: key}
+	}
+	fn(&attempt)
+	s.attempts[key] = attempt
+	s.updates++
+	if s.updates%1000 == 0 {
+		s.cleanup(time.Now())
+	}
+	return attempt, nil
+}
+
+func (s *MemoryLoginAttemptStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) cleanup(now time.Time) {
+	for key, attempt := range s.attempts {
+		if (attempt.LockedUntil == nil || now.After(*attempt.LockedUntil)) && now.Sub(attempt.LastFailureAt) > s.retention {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+// GormLoginAttemptStore is a LoginAttemptStore persisted with gorm,
+// shared by every instance of a service
+type GormLoginAttemptStore struct {
+	db *gorm.DB
+}
+
+// NewGormLoginAttemptStore returns a GormLoginAttemptStore, migrating
+// the login_attempts table
+func NewGormLoginAttemptStore(db *gorm.DB) (*GormLoginAttemptStore, error) {
+	if errMigrate := db.AutoMigrate(&LoginAttempt{}); errMigrate != nil {
+		return nil, fmt.Errorf("cannot migrate login attempts table: %s", errMigrate.Error())
+	}
+	return &GormLoginAttemptStore{db: db}, nil
+}
+
+func (s *GormLoginAttemptStore) Get(ctx context.Context, key string) (LoginAttempt, error) {
+	var attempt LoginAttempt
+	err := s.db.WithContext(ctx).Where("`key` = ?", key).Take(&attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return LoginAttempt{Key: key}, nil
+	}
+	if err != nil {
+		return LoginAttempt{}, fmt.Errorf("cannot get login attempt %s: %s", key, err.Error())
+	}
+	return attempt, nil
+}
+
+func (s *GormLoginAttemptStore) Update(ctx context.Context, key string, fn func(attempt *LoginAttempt)) (LoginAttempt, error) {
+	var attempt LoginAttempt
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		errTake := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("`key` = ?", key).Take(&attempt).Error
+		if errors.Is(errTake, gorm.ErrRecordNotFound) {
+			attempt = LoginAttempt{Key: key}
+		} else if errTake != nil {
+			return errTake
+		}
+		fn(&attempt)
+		return tx.Save(&attempt).Error
+	})
+	if err != nil {
+		return LoginAttempt{}, fmt.Errorf("cannot update login attempt %s: %s", key, err.Error())
+	}
+	return attempt, nil
+}
+
+func (s *GormLoginAttemptStore) Delete(ctx context.Context, key string) error {
+	err := s.db.WithContext(ctx).Where("`key` = ?", key).Delete(&LoginAttempt{}).Error
+	if err != nil {
+		return fmt.Errorf("cannot delete login attempt %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// LoginThrottleStatus is the outcome of a login throttling check
+type LoginThrottleStatus struct {
+	Locked     bool
+	RetryAfter time.Duration
+	Failures   int
+}
+
+// LoginThrottler counts failed logins per user and per ip and locks
+// them after Application.MaxFailedLogins (per user) or
+// Lockout.MaxFailedLoginsPerIp (per ip) failures within the window.
+// Every further lockout lasts BackoffMultiplier times the previous one,
+// up to MaxDurationMinutes
+type LoginThrottler struct {
+	store             LoginAttemptStore
+	maxFailures       int
+	maxFailuresPerIp  int
+	window            time.Duration
+	lockout           time.Duration
+	maxLockout        time.Duration
+	backoffMultiplier float64
+
+	channel      *amqp.Channel
+	notification RabbitInfo
+	source       string
+}
+
+// NewLoginThrottler returns a LoginThrottler configured by the service
+// configuration. If channel is not nil a Notification is published on
+// the notification route every time a user is locked
+func NewLoginThrottler(serviceConfig MicroserviceConfiguration, store LoginAttemptStore, channel *amqp.Channel, source string) (*LoginThrottler, error) {
+	if store == nil {
+		return nil, fmt.Errorf("cannot create login throttler: missing store")
+	}
+	lockoutConfig := serviceConfig.Application.Lockout
+	throttler := &LoginThrottler{
+		store:             store,
+		maxFailures:       serviceConfig.Application.MaxFailedLogins,
+		maxFailuresPerIp:  lockoutConfig.MaxFailedLoginsPerIp,
+		window:            time.Duration(lockoutConfig.WindowMinutes) * time.Minute,
+		lockout:           time.Duration(lockoutConfig.DurationMinutes) * time.Minute,
+		maxLockout:        time.Duration(lockoutConfig.MaxDurationMinutes) * time.Minute,
+		backoffMultiplier: lockoutConfig.BackoffMultiplier,
+		channel:           channel,
+		notification:      serviceConfig.Infrastructure.Rabbit.Notification,
+		source:            source,
+	}
+	if throttler.window <= 0 {
+		throttler.window = 15 * time.Minute
+	}
+	if throttler.lockout <= 0 {
+		throttler.lockout = 15 * time.Minute
+	}
+	if throttler.maxLockout < throttler.lockout {
+		throttler.maxLockout = 24 * time.Hour
+	}
+	if throttler.backoffMultiplier < 1 {
+		throttler.backoffMultiplier = 2
+	}
+	return throttler, nil
+}
+
+func loginThrottleUserKey(user string) string {
+	return "user:" + user
+}
+
+func loginThrottleIpKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns whether the user or the ip are currently locked
+func (t *LoginThrottler) Check(ctx context.Context, user string, ip string) (LoginThrottleStatus, error) {
+	now := time.Now().UTC()
+	status := LoginThrottleStatus{}
+	for _, key := range t.keys(user, ip) {
+		attempt, err := t.store.Get(ctx, key)
+		if err != nil {
+			return LoginThrottleStatus{}, err
+		}
+		if attempt.Failures > status.Failures {
+			status.Failures = attempt.Failures
+		}
+		if attempt.LockedUntil != nil && now.Before(*attempt.LockedUntil) {
+			status.Locked = true
+			if retryAfter := attempt.LockedUntil.Sub(now); retryAfter > status.RetryAfter {
+				status.RetryAfter = retryAfter
+			}
+		}
+	}
+	return status, nil
+}
+
+// LoginReservation is a login attempt counted as failed by Reserve before
+// its outcome is known: Confirm keeps it, Cancel undoes it
+type LoginReservation struct {
+	user    string
+	ip      string
+	counted []string
+	locks   map[string]time.Time
+	// Status is the throttling status with the attempt counted
+	Status LoginThrottleStatus
+}
+
+// Reserve counts a failed login for the user and the ip before the
+// credentials are verified, so that concurrent attempts cannot exceed the
+// thresholds. Keys already locked are not counted: if any is, the returned
+// status is locked and the attempt must be rejected, cancelling the
+// reservation
+func (t *LoginThrottler) Reserve(ctx context.Context, user string, ip string) (LoginThrottleStatus, *LoginReservation, error) {
+	now := time.Now().UTC()
+	status := LoginThrottleStatus{}
+	reservation := &LoginReservation{user: user, ip: ip, locks: map[string]time.Time{}}
+	for _, key := range t.keys(user, ip) {
+		threshold := t.threshold(key, ip)
+		alreadyLocked, counted := false, false
+		var lockedUntil *time.Time
+		attempt, err := t.store.Update(ctx, key, func(attempt *LoginAttempt) {
+			alreadyLocked, counted, lockedUntil = false, false, nil
+			if attempt.LockedUntil != nil && now.Before(*attempt.LockedUntil) {
+				alreadyLocked = true
+				return
+			}
+			if now.Sub(attempt.LastFailureAt) > t.window {
+				attempt.Failures = 0
+			}
+			attempt.Failures++
+			attempt.LastFailureAt = now
+			counted = true
+			if threshold > 0 && attempt.Failures >= threshold {
+				until := now.Add(t.lockoutDuration(attempt.Lockouts))
+				attempt.LockedUntil = &until
+				attempt.Lockouts++
+				attempt.Failures = 0
+				lockedUntil = &until
+			}
+		})
+		if err != nil {
+			if errCancel := t.Cancel(ctx, reservation); errCancel != nil {
+				log.WithError(errCancel).Errorf("cannot cancel login reservation")
+			}
+			return LoginThrottleStatus{}, nil, err
+		}
+		if counted {
+			reservation.counted = append(reservation.counted, key)
+		}
+		if lockedUntil != nil {
+			reservation.locks[key] = *lockedUntil
+		}
+		if attempt.Failures > reservation.Status.Failures {
+			reservation.Status.Failures = attempt.Failures
+		}
+		if attempt.LockedUntil != nil && now.Before(*attempt.LockedUntil) {
+			retryAfter := attempt.LockedUntil.Sub(now)
+			reservation.Status.Locked = true
+			if retryAfter > reservation.Status.RetryAfter {
+				reservation.Status.RetryAfter = retryAfter
+			}
+			if alreadyLocked {
+				status.Locked = true
+				if retryAfter > status.RetryAfter {
+					status.RetryAfter = retryAfter
+				}
+			}
+		}
+	}
+	status.Failures = reservation.Status.Failures
+	return status, reservation, nil
+}
+
+// Confirm keeps the failed login counted by Reserve, notifying the user
+// if the attempt locked the account
+func (t *LoginThrottler) Confirm(reservation *LoginReservation) {
+	for key, lockedUntil := range reservation.locks {
+		log.WithField("key", key).Warnf("login locked until %s after too many failures", lockedUntil.Format(time.RFC3339))
+	}
+	if _, userLocked := reservation.locks[loginThrottleUserKey(reservation.user)]; userLocked {
+		t.notifyLockout(reservation.user, reservation.Status.RetryAfter)
+	}
+}
+
+// Cancel undoes the failed login counted by Reserve, including the
+// lockouts it caused
+func (t *LoginThrottler) Cancel(ctx context.Context, reservation *LoginReservation) error {
+	for _, key := range reservation.counted {
+		threshold := t.threshold(key, reservation.ip)
+		lockedUntil, locked := reservation.locks[key]
+		_, err := t.store.Update(ctx, key, func(attempt *LoginAttempt) {
+			if locked && attempt.LockedUntil != nil && loginThrottleSameTime(*attempt.LockedUntil, lockedUntil) {
+				attempt.LockedUntil = nil
+				attempt.Lockouts--
+				attempt.Failures = threshold - 1
+			} else if attempt.Failures > 0 {
+				attempt.Failures--
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	reservation.counted = nil
+	return nil
+}
+
+// RegisterFailure records a failed login and locks the user or the ip
+// when their threshold is reached. Keys already locked are not counted
+func (t *LoginThrottler) RegisterFailure(ctx context.Context, user string, ip string) (LoginThrottleStatus, error) {
+	_, reservation, err := t.Reserve(ctx, user, ip)
+	if err != nil {
+		return LoginThrottleStatus{}, err
+	}
+	t.Confirm(reservation)
+	return reservation.Status, nil
+}
+
+// RegisterSuccess resets the failed logins of the user. The counter of
+// the ip is kept, otherwise an attacker could reset it by logging into
+// an own account between the guesses, and so is the lockout count, so
+// the next lockout still backs off exponentially
+func (t *LoginThrottler) RegisterSuccess(ctx context.Context, user string, ip string) error {
+	if user == "" {
+		return nil
+	}
+	key := loginThrottleUserKey(user)
+	attempt, err := t.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	// most logins have no failures: avoid a write for every one of them
+	if attempt.Failures == 0 {
+		return nil
+	}
+	_, err = t.store.Update(ctx, key, func(attempt *LoginAttempt) {
+		attempt.Failures = 0
+	})
+	return err
+}
+
+// Unlock removes every counter of the user, e.g. after an administrator
+// or a password reset unlocked the account
+func (t *LoginThrottler) Unlock(ctx context.Context, user string) error {
+	return t.store.Delete(ctx, loginThrottleUserKey(user))
+}
+
+func (t *LoginThrottler) keys(user string, ip string) []string {
+	var keys []string
+	if user != "" {
+		keys = append(keys, loginThrottleUserKey(user))
+	}
+	if ip != "" && t.maxFailuresPerIp > 0 {
+		keys = append(keys, loginThrottleIpKey(ip))
+	}
+	return keys
+}
+
+func (t *LoginThrottler) threshold(key string, ip string) int {
+	if key == loginThrottleIpKey(ip) {
+		return t.maxFailuresPerIp
+	}
+	return t.maxFailures
+}
+
+// loginThrottleSameTime compares lockouts read back from the store,
+// which may have truncated them
+func loginThrottleSameTime(a time.Time, b time.Time) bool {
+	diff := a.Sub(b)
+	return diff > -time.Second && diff < time.Second
+}
+
+func (t *LoginThrottler) lockoutDuration(previousLockouts int) time.Duration {
+	duration := float64(t.lockout) * math.Pow(t.backoffMultiplier, float64(previousLockouts))
+	if duration > float64(t.maxLockout) || math.IsInf(duration, 0) {
+		return t.maxLockout
+	}
+	return time.Duration(duration)
+}
+
+func (t *LoginThrottler) notifyLockout(user string, retryAfter time.Duration) {
+	if t.channel == nil {
+		return
+	}
+	err := PublishToNotification(Notification{
+		UserID:       []string{user},
+		NotifyTypeID: NOTIFY_TYPE_ACCOUNT_LOCKED,
+		Source:       t.source,
+		SourceType:   "rest",
+		Message:      fmt.Sprintf("account locked for %s after too many failed logins", retryAfter.Round(time.Second)),
+	}, t.channel, t.notification.Exchange, t.notification.Key)
+	if err != nil {
+		log.WithError(err).Errorf("cannot send lockout notification")
+	} else {
+		log.Infof("sent lockout notification")
+	}
+}
+
+// RequiresLoginThrottle protects a login route: every attempt is counted
+// as failed before reaching the handler, so that concurrent attempts are
+// throttled too, and locked users or ips are rejected with 429. The
+// attempt stays counted if the response has status 401, otherwise it is
+// cancelled and a 2xx response is registered as a success.
+// userFn extracts the login name from the request
+func RequiresLoginThrottle(throttler *LoginThrottler, userFn func(ctx *fiber.Ctx) string, channel *amqp.Channel, serviceConfig MicroserviceConfiguration, source string) func(ctx *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		user := userFn(ctx)
+		ip := ctx.IP()
+		status, reservation, err := throttler.Reserve(ctx.Context(), user, ip)
+		if err != nil {
+			Elog(ctx).WithError(err).Errorf("cannot check login throttling")
+			return Response(ctx, GetErrorResponse(API_CODE_COMMON_INTERNAL_SERVER_ERROR, "login throttle", "cannot check login attempts"),
+				500, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source)
+		}
+		if status.Locked {
+			if err = throttler.Cancel(ctx.Context(), reservation); err != nil {
+				Elog(ctx).WithError(err).Errorf("cannot cancel login reservation")
+			}
+			Elog(ctx).Warnf("login rejected, locked for %s", status.RetryAfter)
+			ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(status.RetryAfter.Seconds()))))
+			return Response(ctx, GetErrorResponse(API_CODE_COMMON_TOO_MANY_REQUESTS, "login throttle", "too many failed logins, retry later"),
+				429, channel, serviceConfig.Infrastructure.Rabbit.Monitor.Exchange, serviceConfig.Infrastructure.Rabbit.Monitor.Key, source)
+		}
+		errNext := ctx.Next()
+		responseStatus := ctx.Response().StatusCode()
+		var fiberErr *fiber.Error
+		if errors.As(errNext, &fiberErr) {
+			responseStatus = fiberErr.Code
+		} else if errNext != nil {
+			responseStatus = 500
+		}
+		if responseStatus == 401 {
+			throttler.Confirm(reservation)
+			return errNext
+		}
+		if err = throttler.Cancel(ctx.Context(), reservation); err != nil {
+			Elog(ctx).WithError(err).Errorf("cannot cancel login reservation")
+		}
+		if responseStatus >= 200 && responseStatus < 300 {
+			if err = throttler.RegisterSuccess(ctx.Context(), user, ip); err != nil {
+				Elog(ctx).WithError(err).Errorf("cannot register successful login")
+			}
+		}
+		return errNext
+	}
+}
@@ -0,0 +1,111 @@
+package api_common
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func newTestLoginThrottler(t *testing.T, maxFailures int) *LoginThrottler {
+	serviceConfig := MicroserviceConfiguration{}
+	serviceConfig.Application.MaxFailedLogins = maxFailures
+	throttler, err := NewLoginThrottler(serviceConfig, NewMemoryLoginAttemptStore(0), nil, "test")
+	if err != nil {
+		t.Fatalf("cannot create login throttler: %s", err.Error())
+	}
+	return throttler
+}
+
+func TestLoginThrottlerReservesConcurrentAttempts(t *testing.T) {
+	ctx := context.Background()
+	throttler := newTestLoginThrottler(t, 3)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, reservation, err := throttler.Reserve(ctx, "alice", "")
+			if err != nil {
+				t.Errorf("cannot reserve: %s", err.Error())
+				return
+			}
+			if status.Locked {
+				_ = throttler.Cancel(ctx, reservation)
+				return
+			}
+			mu.Lock()
+			allowed++
+			mu.Unlock()
+			throttler.Confirm(reservation)
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 {
+		t.Errorf("expected 3 attempts before the lockout, got %d", allowed)
+	}
+	if status, _ := throttler.Check(ctx, "alice", ""); !status.Locked {
+		t.Errorf("expected the user to be locked")
+	}
+}
+
+func TestLoginThrottlerCancelUndoesTheLockout(t *testing.T) {
+	ctx := context.Background()
+	throttler := newTestLoginThrottler(t, 2)
+	if _, err := throttler.RegisterFailure(ctx, "alice", ""); err != nil {
+		t.Fatalf("cannot register failure: %s", err.Error())
+	}
+	_, reservation, err := throttler.Reserve(ctx, "alice", "")
+	if err != nil || !reservation.Status.Locked {
+		t.Fatalf("expected the reservation to lock the user (%v)", err)
+	}
+	if err = throttler.Cancel(ctx, reservation); err != nil {
+		t.Fatalf("cannot cancel: %s", err.Error())
+	}
+	status, _ := throttler.Check(ctx, "alice", "")
+	if status.Locked || status.Failures != 1 {
+		t.Errorf("expected 1 failure without lockout, got %+v", status)
+	}
+}
+
+func TestRequiresLoginThrottleCountsOnlyUnauthorized(t *testing.T) {
+	throttler := newTestLoginThrottler(t, 2)
+	// the rejections are monitored: buffer them in a sink never started
+	SetMonitorSink(NewMonitorSink(MonitorSinkConfig{}, nil))
+	defer SetMonitorSink(nil)
+	app := fiber.New()
+	app.Use(RequestIdMiddleware(RequestIdConfig{}))
+	app.Post("/login", RequiresLoginThrottle(throttler, func(c *fiber.Ctx) string {
+		return c.Query("user")
+	}, nil, MicroserviceConfiguration{}, "test"), func(c *fiber.Ctx) error {
+		if c.Query("password") != "right" {
+			return c.SendStatus(401)
+		}
+		return c.SendStatus(200)
+	})
+	send := func(password string) int {
+		response, err := app.Test(httptest.NewRequest("POST", "/login?user=alice&password="+password, nil))
+		if err != nil {
+			t.Fatalf("cannot send request: %s", err.Error())
+		}
+		return response.StatusCode
+	}
+	for _, step := range []struct {
+		password string
+		expected int
+	}{
+		{"wrong", 401},
+		{"right", 200},
+		{"wrong", 401},
+		{"wrong", 401},
+		{"right", 429},
+	} {
+		if status := send(step.password); status != step.expected {
+			t.Fatalf("expected %d with password %s, got %d", step.expected, step.password, status)
+		}
+	}
+}
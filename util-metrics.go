@@ -0,0 +1,475 @@
+package api_common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// METRICS_PATH is the default path of the metrics endpoint
+const METRICS_PATH = "/metrics"
+
+// METRICS_DEFAULT_BUCKETS are the default histogram buckets, in seconds
+var METRICS_DEFAULT_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const metricsLabelSeparator = "\xff"
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// MetricsRegistry holds metrics and writes them in the Prometheus
+// text exposition format
+type MetricsRegistry struct {
+	mu         sync.RWMutex
+	metrics    map[string]metric
+	collectors []func()
+}
+
+// NewMetricsRegistry returns an empty MetricsRegistry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{metrics: map[string]metric{}}
+}
+
+// DefaultMetricsRegistry is the registry used by the library
+// instrumentation and served by MetricsHandler
+var DefaultMetricsRegistry = NewMetricsRegistry()
+
+func (r *MetricsRegistry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.metrics[name]; exists {
+		panic(fmt.Sprintf("metric %s already registered", name))
+	}
+	r.metrics[name] = m
+}
+
+// OnCollect registers a function called before every scrape, e.g. to
+// update gauges from external stats
+func (r *MetricsRegistry) OnCollect(collector func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.RLock()
+	collectors := append([]func(){}, r.collectors...)
+	r.mu.RUnlock()
+	for _, collector := range collectors {
+		collector()
+	}
+	r.mu.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counter := &metricsCountingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	for _, name := range names {
+		r.metrics[name].write(buffered)
+	}
+	r.mu.RUnlock()
+	err := buffered.Flush()
+	return counter.n, err
+}
+
+type metricsCountingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *metricsCountingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type metricsVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	mu         sync.Mutex
+	keys       map[string][]string
+}
+
+func (v *metricsVec) key(labels []string) string {
+	if len(labels) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", v.name, len(v.labelNames), len(labels)))
+	}
+	key := strings.Join(labels, metricsLabelSeparator)
+	if _, exists := v.keys[key]; !exists {
+		v.keys[key] = append([]string{}, labels...)
+	}
+	return key
+}
+
+func (v *metricsVec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.keys))
+	for key := range v.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *metricsVec) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, strings.ReplaceAll(strings.ReplaceAll(v.help, `\`, `\\`), "\n", `\n`))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+func (v *metricsVec) labelsString(labels []string, extraName string, extraValue string) string {
+	if len(labels) == 0 && extraName == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)+1)
+	for i, value := range labels {
+		parts = append(parts, v.labelNames[i]+`="`+metricsEscapeLabel(value)+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func metricsEscapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func metricsFormatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// CounterVec is a monotonically increasing counter partitioned by labels
+type CounterVec struct {
+	metricsVec
+	values map[string]float64
+}
+
+// NewCounterVec registers a new CounterVec
+func (r *MetricsRegistry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		metricsVec: metricsVec{name: name, help: help, kind: "counter", labelNames: labelNames, keys: map[string][]string{}},
+		values:     map[string]float64{},
+	}
+	r.register(name, c)
+	return c
+}
+
+// Inc increments the counter with the given label values by 1
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add increments the counter with the given label values by value,
+// which must not be negative
+func (c *CounterVec) Add(value float64, labels ...string) {
+	if value < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(labels)] += value
+}
+
+// Value returns the current value of the counter
+func (c *CounterVec) Value(labels ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labels, metricsLabelSeparator)]
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelsString(c.keys[key], "", ""), metricsFormatFloat(c.values[key]))
+	}
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels
+type GaugeVec struct {
+	metricsVec
+	values map[string]float64
+}
+
+// NewGaugeVec registers a new GaugeVec
+func (r *MetricsRegistry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{
+		metricsVec: metricsVec{name: name, help: help, kind: "gauge", labelNames: labelNames, keys: map[string][]string{}},
+		values:     map[string]float64{},
+	}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the gauge with the given label values
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labels)] = value
+}
+
+// Add adds value, possibly negative, to the gauge with the given label values
+func (g *GaugeVec) Add(value float64, labels ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labels)] += value
+}
+
+// Value returns the current value of the gauge
+func (g *GaugeVec) Value(labels ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[strings.Join(labels, metricsLabelSeparator)]
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w)
+	for _, key := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelsString(g.keys[key], "", ""), metricsFormatFloat(g.values[key]))
+	}
+}
+
+// HistogramVec counts observations in buckets, partitioned by labels
+type HistogramVec struct {
+	metricsVec
+	buckets []float64
+	values  map[string]*metricsHistogramValue
+}
+
+type metricsHistogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a new HistogramVec. If buckets is nil
+// METRICS_DEFAULT_BUCKETS are used
+func (r *MetricsRegistry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = METRICS_DEFAULT_BUCKETS
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		metricsVec: metricsVec{name: name, help: help, kind: "histogram", labelNames: labelNames, keys: map[string][]string{}},
+		buckets:    sorted,
+		values:     map[string]*metricsHistogramValue{},
+	}
+	r.register(name, h)
+	return h
+}
+
+// Observe adds an observation to the histogram with the given label values
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := h.key(labels)
+	histogram, exists := h.values[key]
+	if !exists {
+		histogram = &metricsHistogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = histogram
+	}
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+// ObserveDuration adds the seconds elapsed since start
+func (h *HistogramVec) ObserveDuration(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// Count returns the number of observations
+func (h *HistogramVec) Count(labels ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if histogram, exists := h.values[strings.Join(labels, metricsLabelSeparator)]; exists {
+		return histogram.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, key := range h.sortedKeys() {
+		labels := h.keys[key]
+		histogram := h.values[key]
+		for i, bucket := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelsString(labels, "le", metricsFormatFloat(bucket)), histogram.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelsString(labels, "le", "+Inf"), histogram.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelsString(labels, "", ""), metricsFormatFloat(histogram.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelsString(labels, "", ""), histogram.count)
+	}
+}
+
+// library instrumentation, registered on DefaultMetricsRegistry
+var (
+	metricHttpRequests = DefaultMetricsRegistry.NewCounterVec("http_requests_total",
+		"Number of HTTP requests by method, route and status", "method", "route", "status")
+	metricHttpDuration = DefaultMetricsRegistry.NewHistogramVec("http_request_duration_seconds",
+		"Latency of HTTP requests by method, route and status", nil, "method", "route", "status")
+	metricDbQueryDuration = DefaultMetricsRegistry.NewHistogramVec("db_query_duration_seconds",
+		"Duration of gorm queries by operation, table and result", nil, "operation", "table", "result")
+	metricDbPool = DefaultMetricsRegistry.NewGaugeVec("db_pool_connections",
+		"Connections of the database pool by state", "state")
+	metricDbPoolWaitCount = DefaultMetricsRegistry.NewGaugeVec("db_pool_wait_count",
+		"Total number of connections waited for")
+	metricDbPoolWaitDuration = DefaultMetricsRegistry.NewGaugeVec("db_pool_wait_duration_seconds",
+		"Total time blocked waiting for a new connection")
+	metricRabbitPublished = DefaultMetricsRegistry.NewCounterVec("rabbit_published_total",
+		"Number of messages published by exchange, key and result", "exchange", "key", "result")
+	metricRabbitDelivered = DefaultMetricsRegistry.NewCounterVec("rabbit_delivered_total",
+		"Number of messages delivered to consumers by queue", "queue")
+	metricRabbitConsumed = DefaultMetricsRegistry.NewCounterVec("rabbit_consumed_total",
+		"Number of messages consumed by queue and result", "queue", "result")
+	metricAuthFailures = DefaultMetricsRegistry.NewCounterVec("auth_failures_total",
+		"Number of requests rejected by the Requires* middlewares by middleware and reason", "middleware", "reason")
+)
+
+func metricsResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// MetricsHandler serves the metrics of DefaultMetricsRegistry
+func MetricsHandler() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+		_, err := DefaultMetricsRegistry.WriteTo(c)
+		return err
+	}
+}
+
+// MetricsMiddleware counts the HTTP requests and observes their latency
+// by method, route template and status
+func MetricsMiddleware() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		errNext := c.Next()
+		status := c.Response().StatusCode()
+		if errNext != nil {
+			status = fiber.StatusInternalServerError
+			if fiberErr, ok := errNext.(*fiber.Error); ok {
+				status = fiberErr.Code
+			}
+		}
+		route := "unmatched"
+		if r := c.Route(); r != nil && r.Path != "" && status != fiber.StatusNotFound {
+			route = r.Path
+		}
+		statusString := strconv.Itoa(status)
+		metricHttpRequests.Inc(c.Method(), route, statusString)
+		metricHttpDuration.ObserveDuration(start, c.Method(), route, statusString)
+		return errNext
+	}
+}
+
+// RecordAuthFailure counts a request rejected by an authorization middleware
+func RecordAuthFailure(middleware string, reason string) {
+	metricAuthFailures.Inc(middleware, reason)
+}
+
+// RecordRabbitConsumed counts a consumed message, failed if err is not nil
+func RecordRabbitConsumed(queue string, err error) {
+	metricRabbitConsumed.Inc(queue, metricsResult(err))
+}
+
+const gormMetricsStartKey = "api_common:metrics_start"
+
+// RegisterGormMetrics adds callbacks to db observing the duration of
+// every query
+func RegisterGormMetrics(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(gormMetricsStartKey, time.Now())
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			value, ok := tx.InstanceGet(gormMetricsStartKey)
+			if !ok {
+				return
+			}
+			var err error
+			if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
+				err = tx.Error
+			}
+			metricDbQueryDuration.ObserveDuration(value.(time.Time), operation, tx.Statement.Table, metricsResult(err))
+		}
+	}
+	registrations := []struct {
+		operation string
+		before    func(name string, fn func(*gorm.DB)) error
+		after     func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", db.Callback().Create().Before("gorm:create").Register, db.Callback().Create().After("gorm:create").Register},
+		{"query", db.Callback().Query().Before("gorm:query").Register, db.Callback().Query().After("gorm:query").Register},
+		{"update", db.Callback().Update().Before("gorm:update").Register, db.Callback().Update().After("gorm:update").Register},
+		{"delete", db.Callback().Delete().Before("gorm:delete").Register, db.Callback().Delete().After("gorm:delete").Register},
+		{"row", db.Callback().Row().Before("gorm:row").Register, db.Callback().Row().After("gorm:row").Register},
+		{"raw", db.Callback().Raw().Before("gorm:raw").Register, db.Callback().Raw().After("gorm:raw").Register},
+	}
+	for _, registration := range registrations {
+		if err := registration.before("api_common:metrics_before_"+registration.operation, before); err != nil {
+			return fmt.Errorf("cannot register gorm metrics callback: %s", err.Error())
+		}
+		if err := registration.after("api_common:metrics_after_"+registration.operation, after(registration.operation)); err != nil {
+			return fmt.Errorf("cannot register gorm metrics callback: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// RegisterDBPoolMetrics exposes the stats of the connection pool of db
+// (e.g. returned by GetDB), read at every scrape
+func RegisterDBPoolMetrics(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("cannot get database pool: %s", err.Error())
+	}
+	DefaultMetricsRegistry.OnCollect(func() {
+		stats := sqlDB.Stats()
+		metricDbPool.Set(float64(stats.MaxOpenConnections), "max_open")
+		metricDbPool.Set(float64(stats.OpenConnections), "open")
+		metricDbPool.Set(float64(stats.InUse), "in_use")
+		metricDbPool.Set(float64(stats.Idle), "idle")
+		metricDbPoolWaitCount.Set(float64(stats.WaitCount))
+		metricDbPoolWaitDuration.Set(stats.WaitDuration.Seconds())
+	})
+	return nil
+}
@@ -0,0 +1,405 @@
+package api_common
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// MONITOR_OVERFLOW_DROP drops the messages exceeding the buffer, while
+// MONITOR_OVERFLOW_BLOCK waits up to BlockTimeout for free space
+const MONITOR_OVERFLOW_DROP = "drop"
+const MONITOR_OVERFLOW_BLOCK = "block"
+
+const monitorSpillFile = "monitor-spill.jsonl"
+
+// ErrMonitorSinkFull is returned when a message is dropped for overflow
+var ErrMonitorSinkFull = errors.New("monitor sink buffer full")
+
+// ErrMonitorSinkClosed is returned when enqueuing after Close
+var ErrMonitorSinkClosed = errors.New("monitor sink closed")
+
+var (
+	metricMonitorEnqueued = DefaultMetricsRegistry.NewCounterVec("monitor_sink_enqueued_total",
+		"Number of monitor messages enqueued")
+	metricMonitorDropped = DefaultMetricsRegistry.NewCounterVec("monitor_sink_dropped_total",
+		"Number of monitor messages dropped", "reason")
+	metricMonitorSpilled = DefaultMetricsRegistry.NewCounterVec("monitor_sink_spilled_total",
+		"Number of monitor messages spilled to disk")
+	metricMonitorBuffered = DefaultMetricsRegistry.NewGaugeVec("monitor_sink_buffered",
+		"Number of monitor messages waiting in the buffer of the sink set with SetMonitorSink")
+)
+
+func init() {
+	DefaultMetricsRegistry.OnCollect(func() {
+		buffered := 0
+		if sink := GetMonitorSink(); sink != nil {
+			buffered = len(sink.buffer)
+		}
+		metricMonitorBuffered.Set(float64(buffered))
+	})
+}
+
+var monitorSink atomic.Value
+
+// SetMonitorSink makes PublishToMonitor, and so Response and the Requires*
+// middlewares, enqueue on sink instead of publishing inline
+func SetMonitorSink(sink *MonitorSink) {
+	monitorSink.Store(sink)
+}
+
+// GetMonitorSink returns the sink set with SetMonitorSink, or nil
+func GetMonitorSink() *MonitorSink {
+	sink, _ := monitorSink.Load().(*MonitorSink)
+	return sink
+}
+
+type monitorMessage struct {
+	Exchange     string     `json:"exchange"`
+	Key          string     `json:"key"`
+	Type         string     `json:"type,omitempty"`
+	MessageId    string     `json:"message_id,omitempty"`
+	Timestamp    time.Time  `json:"timestamp,omitempty"`
+	AppId        string     `json:"app_id,omitempty"`
+	ContentType  string     `json:"content_type,omitempty"`
+	DeliveryMode uint8      `json:"delivery_mode,omitempty"`
+	Headers      amqp.Table `json:"headers,omitempty"`
+	Body         []byte     `json:"body"`
+}
+
+// MonitorSinkConfig configures a MonitorSink
+type MonitorSinkConfig struct {
+	// BufferSize is the capacity of the buffer. Default 1024
+	BufferSize int
+	// BatchSize is the maximum number of messages published at once. Default 100
+	BatchSize int
+	// FlushInterval is the maximum time a message waits for its batch. Default 1s
+	FlushInterval time.Duration
+	// Overflow is MONITOR_OVERFLOW_DROP (default) or MONITOR_OVERFLOW_BLOCK
+	Overflow     string
+	BlockTimeout time.Duration
+	// SpillDir, if set, keeps the batches failed for broker outages,
+	// published again once the broker is back
+	SpillDir string
+	// MaxSpillBytes limits the spill file. Default 64MB
+	MaxSpillBytes int64
+}
+
+// MonitorSink publishes the monitor messages in background, in batches,
+// keeping the broker latency and failures off the request path
+type MonitorSink struct {
+	config      MonitorSinkConfig
+	withChannel func(fn func(ch *amqp.Channel) error) error
+	buffer      chan monitorMessage
+	flush       chan chan struct{}
+	closed      chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	spillMu     sync.Mutex
+	started     int32
+	failing     bool
+
+	// closeMu makes Close wait for the messages being enqueued, which
+	// would be lost once run has drained the buffer
+	closeMu sync.RWMutex
+}
+
+// NewMonitorSink returns a sink publishing with withChannel, e.g.
+// RabbitConnectionManager.WithChannel or LockedRabbitChannel. Start must
+// be called to begin publishing
+func NewMonitorSink(config MonitorSinkConfig, withChannel func(fn func(ch *amqp.Channel) error) error) *MonitorSink {
+	if config.BufferSize <= 0 {
+		config.BufferSize = 1024
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.Overflow == "" {
+		config.Overflow = MONITOR_OVERFLOW_DROP
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = 100 * time.Millisecond
+	}
+	if config.MaxSpillBytes <= 0 {
+		config.MaxSpillBytes = 64 << 20
+	}
+	return &MonitorSink{
+		config:      config,
+		withChannel: withChannel,
+		buffer:      make(chan monitorMessage, config.BufferSize),
+		flush:       make(chan chan struct{}),
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start starts publishing in background. With a lifecycle, the sink is
+// flushed and closed at shutdown; register it after the rabbit
+// connection, since the hooks run in reverse order
+func (s *MonitorSink) Start(lifecycle *Lifecycle) {
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return
+	}
+	go s.run()
+	if lifecycle != nil {
+		lifecycle.OnShutdown("monitor sink", s.Close)
+	}
+}
+
+// Enqueue adds a message to the buffer, applying the overflow policy
+// when it is full. The trace context and the request id of ctx are
+// captured now, since the request is over when the message is published
+func (s *MonitorSink) Enqueue(ctx context.Context, exchange string, key string, body []byte) error {
+	return s.EnqueuePublishing(ctx, exchange, key, amqp.Publishing{ContentType: fiber.MIMEApplicationJSON, Body: body})
+}
+
+// EnqueuePublishing is Enqueue for a message with properties, e.g. an
+// EventEnvelope
+func (s *MonitorSink) EnqueuePublishing(ctx context.Context, exchange string, key string, publishing amqp.Publishing) error {
+	headers := amqp.Table{}
+	for k, v := range publishing.Headers {
+		headers[k] = v
+	}
+	msg := monitorMessage{
+		Exchange:     exchange,
+		Key:          key,
+		Type:         publishing.Type,
+		MessageId:    publishing.MessageId,
+		Timestamp:    publishing.Timestamp,
+		AppId:        publishing.AppId,
+		ContentType:  publishing.ContentType,
+		DeliveryMode: publishing.DeliveryMode,
+		Headers:      RabbitHeadersWithRequestId(ctx, RabbitHeadersWithTrace(ctx, headers)),
+		Body:         publishing.Body,
+	}
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	select {
+	case <-s.closed:
+		metricMonitorDropped.Inc("closed")
+		return ErrMonitorSinkClosed
+	default:
+	}
+	select {
+	case s.buffer <- msg:
+		metricMonitorEnqueued.Inc()
+		return nil
+	default:
+	}
+	if s.config.Overflow == MONITOR_OVERFLOW_BLOCK {
+		timer := time.NewTimer(s.config.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case s.buffer <- msg:
+			metricMonitorEnqueued.Inc()
+			return nil
+		case <-timer.C:
+		}
+	}
+	metricMonitorDropped.Inc("overflow")
+	return ErrMonitorSinkFull
+}
+
+func (s *MonitorSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]monitorMessage, 0, s.config.BatchSize)
+	for {
+		select {
+		case msg := <-s.buffer:
+			batch = append(batch, msg)
+			if len(batch) >= s.config.BatchSize {
+				batch = s.publish(batch)
+			}
+		case <-ticker.C:
+			batch = s.publish(batch)
+			if !s.failing {
+				s.replaySpill()
+			}
+		case flushed := <-s.flush:
+			batch = s.drain(batch)
+			close(flushed)
+		case <-s.closed:
+			s.drain(batch)
+			return
+		}
+	}
+}
+
+func (s *MonitorSink) drain(batch []monitorMessage) []monitorMessage {
+	for {
+		select {
+		case msg := <-s.buffer:
+			batch = append(batch, msg)
+			if len(batch) >= s.config.BatchSize {
+				batch = s.publish(batch)
+			}
+		default:
+			return s.publish(batch)
+		}
+	}
+}
+
+// publish publishes the batch, spilling it if the broker is not
+// available, and returns the emptied batch
+func (s *MonitorSink) publish(batch []monitorMessage) []monitorMessage {
+	if len(batch) == 0 {
+		return batch
+	}
+	published := 0
+	err := s.withChannel(func(ch *amqp.Channel) error {
+		for _, msg := range batch[published:] {
+			errPublish := ch.Publish(msg.Exchange, msg.Key, false, false, amqp.Publishing{
+				Type:         msg.Type,
+				MessageId:    msg.MessageId,
+				Timestamp:    msg.Timestamp,
+				AppId:        msg.AppId,
+				ContentType:  TernaryOperator(msg.ContentType == "", fiber.MIMEApplicationJSON, msg.ContentType).(string),
+				DeliveryMode: msg.DeliveryMode,
+				Headers:      msg.Headers,
+				Body:         msg.Body,
+			})
+			metricRabbitPublished.Inc(msg.Exchange, msg.Key, metricsResult(errPublish))
+			if errPublish != nil {
+				return errPublish
+			}
+			published++
+		}
+		return nil
+	})
+	s.failing = err != nil
+	if err != nil {
+		log.WithError(err).Errorf("cannot publish %d monitor messages", len(batch)-published)
+		s.spill(batch[published:])
+	}
+	return batch[:0]
+}
+
+func (s *MonitorSink) spillPath() string {
+	return filepath.Join(s.config.SpillDir, monitorSpillFile)
+}
+
+func (s *MonitorSink) spill(messages []monitorMessage) {
+	if s.config.SpillDir == "" {
+		metricMonitorDropped.Add(float64(len(messages)), "publish")
+		return
+	}
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+	if info, err := os.Stat(s.spillPath()); err == nil && info.Size() >= s.config.MaxSpillBytes {
+		log.Errorf("monitor spill file full, dropping %d messages", len(messages))
+		metricMonitorDropped.Add(float64(len(messages)), "spill_full")
+		return
+	}
+	file, err := os.OpenFile(s.spillPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.WithError(err).Errorf("cannot open monitor spill file")
+		metricMonitorDropped.Add(float64(len(messages)), "spill_error")
+		return
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for i, msg := range messages {
+		if err = encoder.Encode(msg); err != nil {
+			log.WithError(err).Errorf("cannot write monitor spill file")
+			metricMonitorDropped.Add(float64(len(messages)-i), "spill_error")
+			return
+		}
+		metricMonitorSpilled.Inc()
+	}
+}
+
+// replaySpill publishes the spilled messages; those failing again are
+// spilled back
+func (s *MonitorSink) replaySpill() {
+	if s.config.SpillDir == "" {
+		return
+	}
+	s.spillMu.Lock()
+	replaying := s.spillPath() + ".replay"
+	if err := os.Rename(s.spillPath(), replaying); err != nil {
+		s.spillMu.Unlock()
+		return
+	}
+	s.spillMu.Unlock()
+
+	file, err := os.Open(replaying)
+	if err != nil {
+		log.WithError(err).Errorf("cannot open monitor spill file")
+		return
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	batch := make([]monitorMessage, 0, s.config.BatchSize)
+	count := 0
+	for scanner.Scan() {
+		var msg monitorMessage
+		if errDecode := json.Unmarshal(scanner.Bytes(), &msg); errDecode != nil {
+			metricMonitorDropped.Inc("spill_error")
+			continue
+		}
+		batch = append(batch, msg)
+		count++
+		if len(batch) >= s.config.BatchSize {
+			batch = s.publish(batch)
+		}
+	}
+	s.publish(batch)
+	_ = file.Close()
+	if err = os.Remove(replaying); err != nil {
+		log.WithError(err).Errorf("cannot remove monitor spill file")
+	}
+	log.Infof("replayed %d spilled monitor messages", count)
+}
+
+// Flush publishes the buffered messages, waiting until ctx is done
+func (s *MonitorSink) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case s.flush <- flushed:
+	case <-s.done:
+		return ErrMonitorSinkClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting messages and publishes the buffered ones,
+// spilling them if the broker is not available
+func (s *MonitorSink) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.closeMu.Lock()
+		close(s.closed)
+		s.closeMu.Unlock()
+		if atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+			// never started: publishes what was enqueued
+			go s.run()
+		}
+	})
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
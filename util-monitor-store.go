@@ -0,0 +1,409 @@
+package api_common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const monitorPartitionPrefix = "p"
+const monitorPartitionMax = "pmax"
+const monitorPartitionLayout = "20060102"
+const monitorDefaultPageSize = 50
+const monitorMaxPageSize = 500
+const monitorMaxPage = 10000
+const monitorDefaultWindow = 24 * time.Hour
+
+// MonitorEvent is a Monitor message persisted by MonitorStore. On mysql
+// the table is partitioned by day of RecordedAt, which is part of the
+// primary key as partitioning requires. MessageId is unique with
+// RecordedAt, so that a redelivered message is stored once
+type MonitorEvent struct {
+	Id           uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	RecordedAt   time.Time  `gorm:"primaryKey;index;uniqueIndex:idx_monitor_events_message_id,priority:2;not null" json:"recorded_at"`
+	MessageId    *string    `gorm:"size:64;uniqueIndex:idx_monitor_events_message_id,priority:1" json:"message_id,omitempty"`
+	Uuid         string     `gorm:"size:64;index" json:"uuid"`
+	Source       string     `gorm:"size:128;index:idx_monitor_events_source_status" json:"source"`
+	SourceType   string     `gorm:"size:32" json:"source_type"`
+	Success      bool       `json:"success"`
+	Status       int        `gorm:"index:idx_monitor_events_source_status" json:"status"`
+	Endpoint     string     `gorm:"size:2048" json:"endpoint"`
+	Version      int        `json:"version"`
+	Method       string     `gorm:"size:16" json:"method,omitempty"`
+	Route        string     `gorm:"size:255" json:"route,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	DurationMs   float64    `json:"duration_ms,omitempty"`
+	RequestSize  int        `json:"request_size,omitempty"`
+	ResponseSize int        `json:"response_size,omitempty"`
+	Actor        string     `gorm:"size:191" json:"actor,omitempty"`
+	Org          string     `gorm:"size:191" json:"org,omitempty"`
+	Ips          string     `gorm:"size:1024" json:"ips,omitempty"`
+	UserAgent    string     `gorm:"size:512" json:"user_agent,omitempty"`
+	Response     string     `json:"response,omitempty"`
+}
+
+// TableName sets the table used to persist the monitor events
+func (MonitorEvent) TableName() string {
+	return "monitor_events"
+}
+
+// MonitorQuery filters the monitor events: empty fields are ignored,
+// Endpoint matches as a prefix and From/To bound RecordedAt, by default
+// to the last 24 hours unless Uuid is set. Page starts from 1 and is
+// capped to 10000
+type MonitorQuery struct {
+	Uuid       string
+	Source     string
+	Endpoint   string
+	StatusFrom int
+	StatusTo   int
+	From       time.Time
+	To         time.Time
+	Page       int
+	PageSize   int
+}
+
+// MonitorPage is a page of monitor events
+type MonitorPage struct {
+	Events   []MonitorEvent `json:"events"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"page_size"`
+	Total    int64          `json:"total"`
+}
+
+// MonitorStore persists the Monitor messages and queries them
+type MonitorStore struct {
+	// PartitionDaysAhead is the number of daily partitions kept ready. Default 7
+	PartitionDaysAhead int
+	// RetentionDays, if set, drops the partitions older than that
+	RetentionDays int
+
+	db *gorm.DB
+}
+
+// NewMonitorStore returns a MonitorStore on db, usually from GetDB,
+// migrating the monitor_events table and partitioning it on mysql
+func NewMonitorStore(db *gorm.DB) (*MonitorStore, error) {
+	if errMigrate := db.AutoMigrate(&MonitorEvent{}); errMigrate != nil {
+		return nil, fmt.Errorf("cannot migrate monitor events table: %s", errMigrate.Error())
+	}
+	store := &MonitorStore{PartitionDaysAhead: 7, db: db}
+	if err := store.MaintainPartitions(context.Background()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *MonitorStore) partitioned() bool {
+	return s.db.Dialector.Name() == "mysql"
+}
+
+func monitorPartitionName(day time.Time) string {
+	return monitorPartitionPrefix + day.Format(monitorPartitionLayout)
+}
+
+func monitorPartitionDefinition(day time.Time) string {
+	return fmt.Sprintf("PARTITION %s VALUES LESS THAN (TO_DAYS('%s'))",
+		monitorPartitionName(day), day.AddDate(0, 0, 1).Format("2006-01-02"))
+}
+
+func (s *MonitorStore) partitions(ctx context.Context) ([]string, error) {
+	var names []string
+	err := s.db.WithContext(ctx).Raw(
+		"SELECT partition_name FROM information_schema.partitions "+
+			"WHERE table_schema = DATABASE() AND table_name = ? AND partition_name IS NOT NULL",
+		MonitorEvent{}.TableName()).Scan(&names).Error
+	sort.Strings(names)
+	return names, err
+}
+
+// MaintainPartitions creates the daily partitions up to
+// PartitionDaysAhead and drops those beyond RetentionDays. It does
+// nothing on databases other than mysql
+func (s *MonitorStore) MaintainPartitions(ctx context.Context) error {
+	if !s.partitioned() {
+		return nil
+	}
+	existing, err := s.partitions(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get monitor events partitions: %s", err.Error())
+	}
+	table := MonitorEvent{}.TableName()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	db := s.db.WithContext(ctx)
+
+	if len(existing) == 0 {
+		var definitions []string
+		for day := 0; day <= s.PartitionDaysAhead; day++ {
+			definitions = append(definitions, monitorPartitionDefinition(today.AddDate(0, 0, day)))
+		}
+		definitions = append(definitions, fmt.Sprintf("PARTITION %s VALUES LESS THAN MAXVALUE", monitorPartitionMax))
+		err = db.Exec(fmt.Sprintf("ALTER TABLE %s PARTITION BY RANGE (TO_DAYS(recorded_at)) (%s)", table, strings.Join(definitions, ", "))).Error
+		if err != nil {
+			return fmt.Errorf("cannot partition monitor events table: %s", err.Error())
+		}
+		return nil
+	}
+
+	have := map[string]bool{}
+	last := today.AddDate(0, 0, -1)
+	for _, name := range existing {
+		have[name] = true
+		if day, errParse := time.Parse(monitorPartitionLayout, strings.TrimPrefix(name, monitorPartitionPrefix)); errParse == nil && day.After(last) {
+			last = day
+		}
+	}
+	// range partitions can only be added at the end, splitting pmax
+	var definitions []string
+	for day := last.AddDate(0, 0, 1); !day.After(today.AddDate(0, 0, s.PartitionDaysAhead)); day = day.AddDate(0, 0, 1) {
+		definitions = append(definitions, monitorPartitionDefinition(day))
+	}
+	if len(definitions) > 0 {
+		definitions = append(definitions, fmt.Sprintf("PARTITION %s VALUES LESS THAN MAXVALUE", monitorPartitionMax))
+		err = db.Exec(fmt.Sprintf("ALTER TABLE %s REORGANIZE PARTITION %s INTO (%s)", table, monitorPartitionMax, strings.Join(definitions, ", "))).Error
+		if err != nil {
+			return fmt.Errorf("cannot add monitor events partitions: %s", err.Error())
+		}
+	}
+
+	if s.RetentionDays > 0 {
+		limit := today.AddDate(0, 0, -s.RetentionDays)
+		for _, name := range existing {
+			day, errParse := time.Parse(monitorPartitionLayout, strings.TrimPrefix(name, monitorPartitionPrefix))
+			if errParse != nil || !day.Before(limit) {
+				continue
+			}
+			if err = db.Exec(fmt.Sprintf("ALTER TABLE %s DROP PARTITION %s", table, name)).Error; err != nil {
+				return fmt.Errorf("cannot drop monitor events partition %s: %s", name, err.Error())
+			}
+			log.Infof("dropped monitor events partition %s", name)
+		}
+	}
+	return nil
+}
+
+// RunPartitionMaintenance runs MaintainPartitions every interval until
+// ctx is done, to be started with Lifecycle.Go
+func (s *MonitorStore) RunPartitionMaintenance(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.MaintainPartitions(ctx); err != nil {
+				log.WithError(err).Errorln("cannot maintain monitor events partitions")
+			}
+		}
+	}
+}
+
+// Save persists a Monitor message, decoding its base64 response. envelope
+// is the one the message was delivered with: the message is recorded at
+// its StartedAt, or else at the envelope timestamp, and a message already
+// stored with the same envelope id is ignored
+func (s *MonitorStore) Save(ctx context.Context, monitor Monitor, envelope EventEnvelope) error {
+	response, err := base64.URLEncoding.DecodeString(monitor.Response)
+	if err != nil {
+		if response, err = base64.StdEncoding.DecodeString(monitor.Response); err != nil {
+			return fmt.Errorf("cannot decode monitor response: %s", err.Error())
+		}
+	}
+	event := MonitorEvent{
+		RecordedAt:   time.Now().UTC(),
+		Uuid:         monitor.Uuid,
+		Source:       monitor.Source,
+		SourceType:   monitor.SourceType,
+		Success:      monitor.Success,
+		Status:       monitor.Status,
+		Endpoint:     monitor.Endpoint,
+		Version:      TernaryOperator(envelope.Version == 0, 1, envelope.Version).(int),
+		Method:       monitor.Method,
+		Route:        monitor.Route,
+		StartedAt:    monitor.StartedAt,
+		DurationMs:   monitor.DurationMs,
+		RequestSize:  monitor.RequestSize,
+		ResponseSize: monitor.ResponseSize,
+		Actor:        monitor.Actor,
+		Org:          monitor.Org,
+		Ips:          strings.Join(monitor.Ips, ","),
+		UserAgent:    monitor.UserAgent,
+		Response:     string(response),
+	}
+	if monitor.StartedAt != nil {
+		event.RecordedAt = monitor.StartedAt.UTC()
+	} else if !envelope.Timestamp.IsZero() {
+		event.RecordedAt = envelope.Timestamp.UTC()
+	}
+	if envelope.Id != "" {
+		event.MessageId = &envelope.Id
+	}
+	if err = s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&event).Error; err != nil {
+		return fmt.Errorf("cannot save monitor event %s: %s", monitor.Uuid, err.Error())
+	}
+	return nil
+}
+
+// Handler returns the RabbitHandler persisting the MonitorRequest
+// messages, to be used with a Consumer on the monitor queue
+func (s *MonitorStore) Handler() RabbitHandler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		envelope := EventEnvelopeFromDelivery(delivery)
+		// messages published before the envelopes have no type
+		envelope.Type = TernaryOperator(envelope.Type == "", EVENT_TYPE_MONITOR, envelope.Type).(string)
+		upcasted, err := DefaultEventRegistry.Upcast(envelope)
+		if err != nil {
+			return RabbitPermanentError(fmt.Errorf("cannot upcast monitor request: %s", err.Error()))
+		}
+		var request MonitorRequest
+		if err = json.Unmarshal(upcasted.Body, &request); err != nil {
+			return RabbitPermanentError(fmt.Errorf("cannot decode monitor request: %s", err.Error()))
+		}
+		return s.Save(ctx, request.Data.Monitor, envelope)
+	}
+}
+
+// Query returns a page of the events matching query, most recent first
+func (s *MonitorStore) Query(ctx context.Context, query MonitorQuery) (MonitorPage, error) {
+	// the events of a request are looked up at any time
+	if query.Uuid == "" {
+		if query.To.IsZero() {
+			query.To = time.Now().UTC()
+		}
+		if query.From.IsZero() {
+			query.From = query.To.Add(-monitorDefaultWindow)
+		}
+	}
+	if query.Page <= 0 {
+		query.Page = 1
+	}
+	// bounds the offset, which would otherwise overflow
+	if query.Page > monitorMaxPage {
+		query.Page = monitorMaxPage
+	}
+	if query.PageSize <= 0 {
+		query.PageSize = monitorDefaultPageSize
+	}
+	if query.PageSize > monitorMaxPageSize {
+		query.PageSize = monitorMaxPageSize
+	}
+
+	tx := s.db.WithContext(ctx).Model(&MonitorEvent{})
+	if !query.From.IsZero() {
+		tx = tx.Where("recorded_at >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		tx = tx.Where("recorded_at < ?", query.To)
+	}
+	if query.Uuid != "" {
+		tx = tx.Where("uuid = ?", query.Uuid)
+	}
+	if query.Source != "" {
+		tx = tx.Where("source = ?", query.Source)
+	}
+	if query.Endpoint != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query.Endpoint)
+		tx = tx.Where("endpoint LIKE ?", escaped+"%")
+	}
+	if query.StatusFrom > 0 {
+		tx = tx.Where("status >= ?", query.StatusFrom)
+	}
+	if query.StatusTo > 0 {
+		tx = tx.Where("status <= ?", query.StatusTo)
+	}
+
+	page := MonitorPage{Page: query.Page, PageSize: query.PageSize, Events: []MonitorEvent{}}
+	if err := tx.Count(&page.Total).Error; err != nil {
+		return page, fmt.Errorf("cannot count monitor events: %s", err.Error())
+	}
+	err := tx.Order("recorded_at DESC").Order("id DESC").
+		Offset((query.Page - 1) * query.PageSize).Limit(query.PageSize).
+		Find(&page.Events).Error
+	if err != nil {
+		return page, fmt.Errorf("cannot query monitor events: %s", err.Error())
+	}
+	return page, nil
+}
+
+// ParseMonitorQuery reads the query from the parameters uuid, source,
+// endpoint, status_from, status_to, from and to (RFC 3339), page and
+// page_size
+func ParseMonitorQuery(c *fiber.Ctx) (MonitorQuery, error) {
+	query := MonitorQuery{
+		Uuid:     c.Query("uuid"),
+		Source:   c.Query("source"),
+		Endpoint: c.Query("endpoint"),
+	}
+	integers := map[string]*int{
+		"status_from": &query.StatusFrom,
+		"status_to":   &query.StatusTo,
+		"page":        &query.Page,
+		"page_size":   &query.PageSize,
+	}
+	for name, target := range integers {
+		if value := c.Query(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return query, fmt.Errorf("invalid %s: %s", name, value)
+			}
+			*target = n
+		}
+	}
+	times := map[string]*time.Time{"from": &query.From, "to": &query.To}
+	for name, target := range times {
+		if value := c.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s: %s", name, value)
+			}
+			*target = t
+		}
+	}
+	if query.StatusFrom > 0 && query.StatusTo > 0 && query.StatusFrom > query.StatusTo {
+		return query, fmt.Errorf("status_from greater than status_to")
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return query, fmt.Errorf("from must be before to")
+	}
+	return query, nil
+}
+
+// MonitorQueryHandler serves the monitor events filtered with the
+// parameters of ParseMonitorQuery; protect it with RequiresAccessToken
+// and RequiresHierarchy. The events are never sent back to the monitor
+// with the successful responses
+func MonitorQueryHandler(store *MonitorStore, channel *amqp.Channel, serviceConfig MicroserviceConfiguration, source string) func(c *fiber.Ctx) error {
+	monitor := serviceConfig.Infrastructure.Rabbit.Monitor
+	return func(c *fiber.Ctx) error {
+		query, err := ParseMonitorQuery(c)
+		if err != nil {
+			return Response(c, GetErrorResponse(API_CODE_COMMON_BAD_REQUEST, "monitor query", err.Error()),
+				400, channel, monitor.Exchange, monitor.Key, source)
+		}
+		page, err := store.Query(c.UserContext(), query)
+		if err != nil {
+			Elog(c).WithError(err).Errorf("cannot query monitor events")
+			return Response(c, GetErrorResponse(API_CODE_COMMON_INTERNAL_SERVER_ERROR, "monitor query", "cannot query monitor events"),
+				500, channel, monitor.Exchange, monitor.Key, source)
+		}
+		// the monitor records the page without the events
+		summary := page
+		summary.Events = nil
+		if err = PublishToMonitor(GetSuccessResponse(summary), c, 200, channel, monitor.Exchange, monitor.Key, source, "rest", nil, nil); err != nil {
+			Elog(c).WithError(err).Errorf("cannot send message to monitor queue")
+		}
+		return c.Status(200).JSON(GetSuccessResponse(page))
+	}
+}
@@ -0,0 +1,94 @@
+package api_common
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/streadway/amqp"
+)
+
+// monitorMaxRawBody bounds the response bodies sent by MonitorMiddleware
+// when no response has been recorded, e.g. for file downloads
+const monitorMaxRawBody = 64 * 1024
+
+type monitorState struct {
+	start      time.Time
+	captured   bool
+	response   []byte
+	sourceType string
+	url        string
+}
+
+func getMonitorState(c *fiber.Ctx) *monitorState {
+	state, _ := c.Locals(CTX_MONITOR).(*monitorState)
+	return state
+}
+
+// enrichMonitor adds the request details to monitor; the duration is
+// set only if start is known
+func enrichMonitor(c *fiber.Ctx, monitor *Monitor, start time.Time) {
+	monitor.Method = c.Method()
+	if route := c.Route(); route != nil {
+		monitor.Route = route.Path
+	}
+	monitor.RequestSize = len(c.Request().Body())
+	monitor.Actor, monitor.Org, _, _, _ = GetJwtUser(c)
+	monitor.Ips = append([]string{c.IP()}, c.IPs()...)
+	monitor.UserAgent = c.Get(fiber.HeaderUserAgent)
+	if !start.IsZero() {
+		started := start.UTC()
+		monitor.StartedAt = &started
+		monitor.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	}
+}
+
+// MonitorMiddleware sends a Monitor message for every request once it
+// completes, with its duration and sizes. The response recorded by the
+// last call to Response, or to the Requires* middlewares, is used if
+// any, otherwise the response body if it is JSON and not larger than
+// 64KB. Register it before the auth middlewares
+func MonitorMiddleware(channel *amqp.Channel, serviceConfig MicroserviceConfiguration, source string) func(c *fiber.Ctx) error {
+	exchange := serviceConfig.Infrastructure.Rabbit.Monitor.Exchange
+	key := serviceConfig.Infrastructure.Rabbit.Monitor.Key
+	return func(c *fiber.Ctx) error {
+		state := &monitorState{start: time.Now(), sourceType: "rest"}
+		c.Locals(CTX_MONITOR, state)
+		errNext := c.Next()
+
+		status := c.Response().StatusCode()
+		if errNext != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(errNext, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+		response := state.response
+		if !state.captured {
+			body := c.Response().Body()
+			contentType := string(c.Response().Header.ContentType())
+			if len(body) <= monitorMaxRawBody && strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+				response = body
+			}
+		}
+		requestId, _ := c.Locals(CTX_REQUESTID).(string)
+		monitor := Monitor{
+			Response:     base64.URLEncoding.EncodeToString(GetRedactor().RedactJSON(response)),
+			Uuid:         requestId,
+			Source:       source,
+			SourceType:   state.sourceType,
+			Success:      TernaryOperator(status != 200, false, true).(bool),
+			Status:       status,
+			Endpoint:     TernaryOperator(state.url != "", state.url, c.OriginalURL()).(string),
+			ResponseSize: len(c.Response().Body()),
+		}
+		enrichMonitor(c, &monitor, state.start)
+		if err := publishMonitor(c.UserContext(), monitor, channel, exchange, key); err != nil {
+			Elog(c).WithError(err).Errorf("cannot send message to monitor queue")
+		}
+		return errNext
+	}
+}
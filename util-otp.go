@@ -0,0 +1,366 @@
+package api_common
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const otpDefaultCodeLength = 6
+const otpDefaultTokenLength = 43
+const otpDefaultTtlMinutes = 15
+const otpDefaultMaxAttempts = 5
+
+// ErrOtpNotFound is returned when there is no pending code or token
+var ErrOtpNotFound = errors.New("one-time code not found")
+
+// ErrOtpExpired is returned when the code or token is expired
+var ErrOtpExpired = errors.New("one-time code expired")
+
+// ErrOtpTooManyAttempts is returned when the code has been verified
+// with a wrong value too many times
+var ErrOtpTooManyAttempts = errors.New("one-time code verified too many times")
+
+// ErrOtpInvalid is returned when the code or token does not match
+var ErrOtpInvalid = errors.New("one-time code not valid")
+
+// OneTimeCode is a pending code or token. Only the sha256 of the value
+// is stored
+type OneTimeCode struct {
+	Id        string `gorm:"primaryKey;size:32"`
+	Purpose   string `gorm:"size:64;not null;index:idx_one_time_codes_subject"`
+	Subject   string `gorm:"size:191;not null;index:idx_one_time_codes_subject"`
+	Hash      string `gorm:"size:64;not null;index"`
+	Attempts  int    `gorm:"not null;default:0"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TableName sets the table used to persist the one-time codes
+func (OneTimeCode) TableName() string {
+	return "one_time_codes"
+}
+
+// OneTimeCodeStore persists OneTimeCode records. Replace stores a new
+// code invalidating the pending ones with the same purpose and subject.
+// The Update methods apply fn atomically to the pending code and
+// return ErrOtpNotFound if there is none
+type OneTimeCodeStore interface {
+	Replace(ctx context.Context, code OneTimeCode) error
+	UpdateBySubject(ctx context.Context, purpose string, subject string, fn func(code *OneTimeCode)) (OneTimeCode, error)
+	UpdateByHash(ctx context.Context, purpose string, hash string, fn func(code *OneTimeCode)) (OneTimeCode, error)
+}
+
+// MemoryOneTimeCodeStore is a OneTimeCodeStore kept in memory,
+// suitable for single instance services and tests
+type MemoryOneTimeCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]OneTimeCode
+}
+
+// NewMemoryOneTimeCodeStore returns an empty MemoryOneTimeCodeStore
+func NewMemoryOneTimeCodeStore() *MemoryOneTimeCodeStore {
+	return &MemoryOneTimeCodeStore{codes: map[string]OneTimeCode{}}
+}
+
+func (s *MemoryOneTimeCodeStore) Replace(_ context.Context, code OneTimeCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, pending := range s.codes {
+		if (pending.Purpose == code.Purpose && pending.Subject == code.Subject) || now.After(pending.ExpiresAt) {
+			delete(s.codes, id)
+		}
+	}
+	s.codes[code.Id] = code
+	return nil
+}
+
+func (s *MemoryOneTimeCodeStore) UpdateBySubject(_ context.Context, purpose string, subject string, fn func(code *OneTimeCode)) (OneTimeCode, error) {
+	return s.update(func(code OneTimeCode) bool {
+		return code.Purpose == purpose && code.Subject == subject
+	}, fn)
+}
+
+func (s *MemoryOneTimeCodeStore) UpdateByHash(_ context.Context, purpose string, hash string, fn func(code *OneTimeCode)) (OneTimeCode, error) {
+	return s.update(func(code OneTimeCode) bool {
+		return code.Purpose == purpose && code.Hash == hash
+	}, fn)
+}
+
+func (s *MemoryOneTimeCodeStore) update(match func(code OneTimeCode) bool, fn func(code *OneTimeCode)) (OneTimeCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, code := range s.codes {
+		if code.UsedAt == nil && match(code) {
+			fn(&code)
+			s.codes[id] = code
+			return code, nil
+		}
+	}
+	return OneTimeCode{}, ErrOtpNotFound
+}
+
+// GormOneTimeCodeStore is a OneTimeCodeStore persisted with gorm
+type GormOneTimeCodeStore struct {
+	db *gorm.DB
+}
+
+// NewGormOneTimeCodeStore returns a GormOneTimeCodeStore, migrating
+// the one_time_codes table
+func NewGormOneTimeCodeStore(db *gorm.DB) (*GormOneTimeCodeStore, error) {
+	if errMigrate := db.AutoMigrate(&OneTimeCode{}); errMigrate != nil {
+		return nil, fmt.Errorf("cannot migrate one-time codes table: %s", errMigrate.Error())
+	}
+	return &GormOneTimeCodeStore{db: db}, nil
+}
+
+func (s *GormOneTimeCodeStore) Replace(ctx context.Context, code OneTimeCode) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		errDelete := tx.Where("purpose = ? AND subject = ?", code.Purpose, code.Subject).
+			Or("expires_at < ?", time.Now().UTC()).
+			Delete(&OneTimeCode{}).Error
+		if errDelete != nil {
+			return errDelete
+		}
+		return tx.Create(&code).Error
+	})
+	if err != nil {
+		return fmt.Errorf("cannot store one-time code: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *GormOneTimeCodeStore) UpdateBySubject(ctx context.Context, purpose string, subject string, fn func(code *OneTimeCode)) (OneTimeCode, error) {
+	return s.update(ctx, fn, "purpose = ? AND subject = ? AND used_at IS NULL", purpose, subject)
+}
+
+func (s *GormOneTimeCodeStore) UpdateByHash(ctx context.Context, purpose string, hash string, fn func(code *OneTimeCode)) (OneTimeCode, error) {
+	return s.update(ctx, fn, "purpose = ? AND hash = ? AND used_at IS NULL", purpose, hash)
+}
+
+func (s *GormOneTimeCodeStore) update(ctx context.Context, fn func(code *OneTimeCode), query string, args ...interface{}) (OneTimeCode, error) {
+	var code OneTimeCode
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		errTake := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(query, args...).Order("created_at DESC").Take(&code).Error
+		if errTake != nil {
+			return errTake
+		}
+		fn(&code)
+		return tx.Save(&code).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return OneTimeCode{}, ErrOtpNotFound
+	}
+	if err != nil {
+		return OneTimeCode{}, fmt.Errorf("cannot update one-time code: %s", err.Error())
+	}
+	return code, nil
+}
+
+// OtpService issues numeric codes and magic-link tokens, sends them
+// through Ermes and verifies them. Every code is single-use, expires
+// after Otp.TtlMinutes and is invalidated after Otp.MaxAttempts wrong
+// verifications
+type OtpService struct {
+	store         OneTimeCodeStore
+	codeLength    int
+	tokenLength   int
+	ttl           time.Duration
+	maxAttempts   int
+	magicLinkBase string
+
+	channel *amqp.Channel
+	ermes   RabbitInfo
+	reply   RabbitInfo
+}
+
+// NewOtpService returns an OtpService configured by the Application.Otp
+// section. Messages are published to Ermes on the Rabbit.Producer route,
+// asking Ermes to reply on the Rabbit.Consumer route
+func NewOtpService(serviceConfig MicroserviceConfiguration, store OneTimeCodeStore, channel *amqp.Channel) (*OtpService, error) {
+	if store == nil {
+		return nil, fmt.Errorf("cannot create otp service: missing store")
+	}
+	config := serviceConfig.Application.Otp
+	service := &OtpService{
+		store:       store,
+		codeLength:  config.CodeLength,
+		tokenLength: config.TokenLength,
+		ttl:         time.Duration(config.TtlMinutes) * time.Minute,
+		maxAttempts: config.MaxAttempts,
+		channel:     channel,
+		ermes:       serviceConfig.Infrastructure.Rabbit.Producer,
+		reply:       serviceConfig.Infrastructure.Rabbit.Consumer,
+	}
+	if service.codeLength <= 0 {
+		service.codeLength = otpDefaultCodeLength
+	}
+	if service.tokenLength <= 0 {
+		service.tokenLength = otpDefaultTokenLength
+	}
+	if service.ttl <= 0 {
+		service.ttl = otpDefaultTtlMinutes * time.Minute
+	}
+	if service.maxAttempts <= 0 {
+		service.maxAttempts = otpDefaultMaxAttempts
+	}
+	if config.MagicLinkPath != "" {
+		service.magicLinkBase = strings.TrimRight(serviceConfig.Application.BaseUrl, "/") + "/" + strings.TrimLeft(config.MagicLinkPath, "/")
+	}
+	return service, nil
+}
+
+func (s *OtpService) issue(ctx context.Context, purpose string, subject string, value string) error {
+	now := time.Now().UTC()
+	id, errId := RandomGenerateUuidString(false, 32)
+	if errId != nil {
+		return errId
+	}
+	return s.store.Replace(ctx, OneTimeCode{
+		Id:        id,
+		Purpose:   purpose,
+		Subject:   subject,
+		Hash:      CryptoSha256String(value),
+		ExpiresAt: now.Add(s.ttl),
+		CreatedAt: now,
+	})
+}
+
+// IssueCode returns a new numeric code for the subject, invalidating
+// the previous one with the same purpose
+func (s *OtpService) IssueCode(ctx context.Context, purpose string, subject string) (string, error) {
+	code, errCode := RandomGenerateDigits(s.codeLength)
+	if errCode != nil {
+		return "", fmt.Errorf("cannot generate code: %s", errCode.Error())
+	}
+	if errIssue := s.issue(ctx, purpose, subject, code); errIssue != nil {
+		return "", errIssue
+	}
+	return code, nil
+}
+
+// IssueToken returns a new URL-safe token for the subject, invalidating
+// the previous one with the same purpose
+func (s *OtpService) IssueToken(ctx context.Context, purpose string, subject string) (string, error) {
+	token, errToken := RandomGenerateToken(s.tokenLength)
+	if errToken != nil {
+		return "", fmt.Errorf("cannot generate token: %s", errToken.Error())
+	}
+	if errIssue := s.issue(ctx, purpose, subject, token); errIssue != nil {
+		return "", errIssue
+	}
+	return token, nil
+}
+
+// MagicLink returns the link built on Application.BaseUrl and
+// Otp.MagicLinkPath carrying the given token
+func (s *OtpService) MagicLink(token string) (string, error) {
+	if s.magicLinkBase == "" {
+		return "", fmt.Errorf("cannot build magic link: missing otp magic link path")
+	}
+	separator := "?"
+	if strings.Contains(s.magicLinkBase, "?") {
+		separator = "&"
+	}
+	return s.magicLinkBase + separator + "token=" + url.QueryEscape(token), nil
+}
+
+// SendCode issues a numeric code and sends it by email through Ermes
+// with the given template (e.g. Template.AfterCreation), passing the
+// code as first template parameter
+func (s *OtpService) SendCode(ctx context.Context, purpose string, subject string, email string, template string) error {
+	code, errIssue := s.IssueCode(ctx, purpose, subject)
+	if errIssue != nil {
+		return errIssue
+	}
+	return s.send(subject, email, template, code)
+}
+
+// SendMagicLink issues a token and sends the magic link by email through
+// Ermes with the given template (e.g. Template.AfterForgotPassword),
+// passing the link as first template parameter
+func (s *OtpService) SendMagicLink(ctx context.Context, purpose string, subject string, email string, template string) error {
+	token, errIssue := s.IssueToken(ctx, purpose, subject)
+	if errIssue != nil {
+		return errIssue
+	}
+	link, errLink := s.MagicLink(token)
+	if errLink != nil {
+		return errLink
+	}
+	return s.send(subject, email, template, link)
+}
+
+func (s *OtpService) send(subject string, email string, template string, value string) error {
+	if s.channel == nil {
+		return fmt.Errorf("cannot send one-time code: missing rabbit channel")
+	}
+	parameters := []string{value}
+	_, _, err := PublishToErmes(nil, 200, email, template, &parameters,
+		s.reply.Exchange, s.reply.Queue, s.reply.Key, s.ermes.Exchange, s.ermes.Key, subject, s.channel)
+	if err != nil {
+		return fmt.Errorf("cannot send one-time code to ermes: %s", err.Error())
+	}
+	log.Debugf("sent one-time code with template %s to ermes", template)
+	return nil
+}
+
+func (s *OtpService) check(code *OneTimeCode, value string, result *error) {
+	now := time.Now().UTC()
+	if now.After(code.ExpiresAt) {
+		*result = ErrOtpExpired
+		return
+	}
+	if code.Attempts >= s.maxAttempts {
+		*result = ErrOtpTooManyAttempts
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(code.Hash), []byte(CryptoSha256String(value))) != 1 {
+		code.Attempts++
+		*result = ErrOtpInvalid
+		return
+	}
+	code.UsedAt = &now
+	*result = nil
+}
+
+// VerifyCode checks the code of the subject. On success the code is
+// consumed, otherwise one of the ErrOtp* errors is returned
+func (s *OtpService) VerifyCode(ctx context.Context, purpose string, subject string, code string) error {
+	var result error
+	_, errUpdate := s.store.UpdateBySubject(ctx, purpose, subject, func(pending *OneTimeCode) {
+		s.check(pending, strings.TrimSpace(code), &result)
+	})
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return result
+}
+
+// VerifyToken checks a magic-link token and returns the subject it has
+// been issued for. On success the token is consumed
+func (s *OtpService) VerifyToken(ctx context.Context, purpose string, token string) (string, error) {
+	var result error
+	pending, errUpdate := s.store.UpdateByHash(ctx, purpose, CryptoSha256String(token), func(pending *OneTimeCode) {
+		s.check(pending, token, &result)
+	})
+	if errUpdate != nil {
+		return "", errUpdate
+	}
+	if result != nil {
+		return "", result
+	}
+	return pending.Subject, nil
+}
@@ -0,0 +1,220 @@
+package api_common
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// PASSWORD_RULE_* identify the rules reported in a PasswordViolation
+const (
+	PASSWORD_RULE_MIN_LENGTH    = "min_length"
+	PASSWORD_RULE_MAX_LENGTH    = "max_length"
+	PASSWORD_RULE_MIN_LOWER     = "min_lower"
+	PASSWORD_RULE_MIN_UPPER     = "min_upper"
+	PASSWORD_RULE_MIN_NUMERIC   = "min_numeric"
+	PASSWORD_RULE_MIN_SPECIAL   = "min_special"
+	PASSWORD_RULE_MAX_REPEATED  = "max_repeated_chars"
+	PASSWORD_RULE_BANNED_WORD   = "banned_word"
+	PASSWORD_RULE_HISTORY_REUSE = "history_reuse"
+)
+
+// PasswordViolation describes a password policy rule not respected
+// by a password
+type PasswordViolation struct {
+	Rule   string `json:"rule"`
+	Limit  int    `json:"limit,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// PasswordExpiry describes the expiration state of a password
+type PasswordExpiry struct {
+	Expired   bool       `json:"expired"`
+	Warning   bool       `json:"warning"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	DaysLeft  int        `json:"days_left"`
+}
+
+// PasswordPolicyEngine enforces the Application.Password configuration
+type PasswordPolicyEngine struct {
+	policy      PasswordPolicy
+	duration    int
+	warning     int
+	bannedWords []string
+	hasher      *PasswordHasher
+}
+
+// NewPasswordPolicyEngine returns a PasswordPolicyEngine for the given
+// configuration. The hasher is used to check the password history and
+// can be nil if Policy.HistoryDepth is 0
+func NewPasswordPolicyEngine(config Password, hasher *PasswordHasher) (*PasswordPolicyEngine, error) {
+	engine := &PasswordPolicyEngine{
+		policy:   config.Policy,
+		duration: config.PwdDuration,
+		warning:  config.PwdWarning,
+		hasher:   hasher,
+	}
+	if engine.policy.HistoryDepth > 0 && hasher == nil {
+		return nil, fmt.Errorf("cannot create password policy: history check requires a password hasher")
+	}
+	if engine.policy.MaxLength > 0 && engine.policy.MaxLength < engine.policy.MinLength {
+		return nil, fmt.Errorf("cannot create password policy: max length %d lower than min length %d",
+			engine.policy.MaxLength, engine.policy.MinLength)
+	}
+	if engine.policy.BannedWordsFilepath != "" {
+		words, errGetWords := GetStringArrayFromFile(engine.policy.BannedWordsFilepath)
+		if errGetWords != nil {
+			return nil, errGetWords
+		}
+		for _, word := range words {
+			word = strings.ToLower(strings.TrimSpace(word))
+			if word != "" && !strings.HasPrefix(word, "#") {
+				engine.bannedWords = append(engine.bannedWords, word)
+			}
+		}
+		log.Debugf("loaded %d banned words for password policy", len(engine.bannedWords))
+	}
+	return engine, nil
+}
+
+// Validate checks the password against every rule of the policy and
+// returns the list of violated rules, empty if the password is valid.
+// history contains the hashes of the previous passwords, newest first
+func (e *PasswordPolicyEngine) Validate(password string, history []string) []PasswordViolation {
+	violations := []PasswordViolation{}
+	length := len([]rune(password))
+	if e.policy.MinLength > 0 && length < e.policy.MinLength {
+		violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_MIN_LENGTH, Limit: e.policy.MinLength,
+			Detail: fmt.Sprintf("password must be at least %d characters long", e.policy.MinLength)})
+	}
+	if e.policy.MaxLength > 0 && length > e.policy.MaxLength {
+		violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_MAX_LENGTH, Limit: e.policy.MaxLength,
+			Detail: fmt.Sprintf("password must be at most %d characters long", e.policy.MaxLength)})
+	}
+	lower, upper, numeric, special := passwordCountCharTypes(password)
+	if lower < e.policy.MinLower {
+		violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_MIN_LOWER, Limit: e.policy.MinLower,
+			Detail: fmt.Sprintf("password must contain at least %d lowercase letters", e.policy.MinLower)})
+	}
+	if upper < e.policy.MinUpper {
+		violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_MIN_UPPER, Limit: e.policy.MinUpper,
+			Detail: fmt.Sprintf("password must contain at least %d uppercase letters", e.policy.MinUpper)})
+	}
+	if numeric < e.policy.MinNumeric {
+		violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_MIN_NUMERIC, Limit: e.policy.MinNumeric,
+			Detail: fmt.Sprintf("password must contain at least %d digits", e.policy.MinNumeric)})
+	}
+	if special < e.policy.MinSpecial {
+		violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_MIN_SPECIAL, Limit: e.policy.MinSpecial,
+			Detail: fmt.Sprintf("password must contain at least %d special characters", e.policy.MinSpecial)})
+	}
+	if e.policy.MaxRepeatedChars > 0 && passwordMaxRepeated(password) > e.policy.MaxRepeatedChars {
+		violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_MAX_REPEATED, Limit: e.policy.MaxRepeatedChars,
+			Detail: fmt.Sprintf("password must not repeat the same character more than %d times in a row", e.policy.MaxRepeatedChars)})
+	}
+	lowerPassword := strings.ToLower(password)
+	for _, word := range e.bannedWords {
+		if strings.Contains(lowerPassword, word) {
+			violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_BANNED_WORD,
+				Detail: "password contains a word that is not allowed"})
+			break
+		}
+	}
+	if e.policy.HistoryDepth > 0 {
+		for i, hash := range history {
+			if i >= e.policy.HistoryDepth {
+				break
+			}
+			reused, errVerify := e.hasher.Verify(hash, password)
+			if errVerify != nil {
+				log.WithError(errVerify).Warnln("cannot verify password history entry")
+				continue
+			}
+			if reused {
+				violations = append(violations, PasswordViolation{Rule: PASSWORD_RULE_HISTORY_REUSE, Limit: e.policy.HistoryDepth,
+					Detail: fmt.Sprintf("password must differ from the last %d passwords", e.policy.HistoryDepth)})
+				break
+			}
+		}
+	}
+	return violations
+}
+
+// CheckExpiry returns the expiration state of a password changed at
+// changedAt, according to PwdDuration and PwdWarning (in days).
+// A PwdDuration lower or equal to 0 means passwords never expire
+func (e *PasswordPolicyEngine) CheckExpiry(changedAt time.Time, now time.Time) PasswordExpiry {
+	if e.duration <= 0 {
+		return PasswordExpiry{DaysLeft: -1}
+	}
+	expiresAt := changedAt.AddDate(0, 0, e.duration)
+	daysLeft := int(expiresAt.Sub(now).Hours() / 24)
+	if now.After(expiresAt) || now.Equal(expiresAt) {
+		return PasswordExpiry{Expired: true, ExpiresAt: &expiresAt, DaysLeft: 0}
+	}
+	return PasswordExpiry{
+		Warning:   e.warning > 0 && now.After(expiresAt.AddDate(0, 0, -e.warning)),
+		ExpiresAt: &expiresAt,
+		DaysLeft:  daysLeft,
+	}
+}
+
+// GetPasswordPolicyErrorResponse returns an error response including
+// the list of violated rules
+func GetPasswordPolicyErrorResponse(reason string, violations []PasswordViolation) interface{} {
+	details := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		details = append(details, violation.Rule)
+	}
+	return fiber.Map{
+		"status": false,
+		"data": fiber.Map{
+			"error": Error{
+				ErrorCode: API_CODE_COMMON_PASSWORD_POLICY,
+				Reason:    reason,
+				Detail:    strings.Join(details, ","),
+			},
+			"violations": violations,
+		},
+	}
+}
+
+// passwordCountCharTypes is CountCharTypes by rune: accented letters are
+// lower or upper case, and letters without case, e.g. in CJK scripts,
+// are neither letters of a case nor special characters
+func passwordCountCharTypes(password string) (lower int, upper int, numeric int, special int) {
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower++
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsDigit(r):
+			numeric++
+		case !unicode.IsLetter(r):
+			special++
+		}
+	}
+	return lower, upper, numeric, special
+}
+
+func passwordMaxRepeated(password string) int {
+	maxRepeated, current := 0, 0
+	var previous rune
+	for i, r := range password {
+		if i > 0 && r == previous {
+			current++
+		} else {
+			current = 1
+		}
+		if current > maxRepeated {
+			maxRepeated = current
+		}
+		previous = r
+	}
+	return maxRepeated
+}
@@ -0,0 +1,22 @@
+package api_common
+
+import "testing"
+
+func TestPasswordCountCharTypes(t *testing.T) {
+	tests := []struct {
+		password                       string
+		lower, upper, numeric, special int
+	}{
+		{password: "aB3$", lower: 1, upper: 1, numeric: 1, special: 1},
+		{password: "èÉü", lower: 2, upper: 1},
+		{password: "密码١٢", numeric: 2},
+		{password: "a b€", lower: 2, special: 2},
+	}
+	for _, test := range tests {
+		lower, upper, numeric, special := passwordCountCharTypes(test.password)
+		if lower != test.lower || upper != test.upper || numeric != test.numeric || special != test.special {
+			t.Errorf("%s: expected %d %d %d %d, got %d %d %d %d", test.password,
+				test.lower, test.upper, test.numeric, test.special, lower, upper, numeric, special)
+		}
+	}
+}
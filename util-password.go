@@ -0,0 +1,290 @@
+package api_common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PASSWORD_ALGORITHM_ARGON2ID selects argon2id hashing
+const PASSWORD_ALGORITHM_ARGON2ID = "argon2id"
+
+// PASSWORD_ALGORITHM_BCRYPT selects bcrypt hashing
+const PASSWORD_ALGORITHM_BCRYPT = "bcrypt"
+
+// default parameters, following the OWASP recommendations
+const passwordDefaultArgon2Memory = 64 * 1024
+const passwordDefaultArgon2Iterations = 3
+const passwordDefaultArgon2Parallelism = 2
+const passwordDefaultArgon2SaltLength = 16
+const passwordDefaultArgon2KeyLength = 32
+const passwordDefaultBcryptCost = 12
+
+// PasswordHasher hashes and verifies passwords with argon2id or bcrypt.
+// Argon2id hashes are encoded in PHC format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash), bcrypt hashes in the
+// usual modular crypt format, so hashes created by CryptoHashText are
+// still accepted and reported by NeedsRehash
+type PasswordHasher struct {
+	algorithm string
+	argon2    Argon2Params
+	bcrypt    BcryptParams
+	pepper    []byte
+	pepperId  string
+}
+
+// NewPasswordHasher returns a PasswordHasher configured by the
+// Application.Password.Hashing section. Missing parameters are set
+// to safe defaults and the pepper, if any, is read from its secret file
+func NewPasswordHasher(config PasswordHashing) (*PasswordHasher, error) {
+	hasher := &PasswordHasher{
+		algorithm: strings.ToLower(config.Algorithm),
+		argon2:    config.Argon2,
+		bcrypt:    config.Bcrypt,
+	}
+	if hasher.algorithm == "" {
+		hasher.algorithm = PASSWORD_ALGORITHM_ARGON2ID
+	}
+	if hasher.algorithm != PASSWORD_ALGORITHM_ARGON2ID && hasher.algorithm != PASSWORD_ALGORITHM_BCRYPT {
+		return nil, fmt.Errorf("cannot create password hasher: unsupported algorithm %s", config.Algorithm)
+	}
+	if hasher.argon2.Memory == 0 {
+		hasher.argon2.Memory = passwordDefaultArgon2Memory
+	}
+	if hasher.argon2.Iterations == 0 {
+		hasher.argon2.Iterations = passwordDefaultArgon2Iterations
+	}
+	if hasher.argon2.Parallelism == 0 {
+		hasher.argon2.Parallelism = passwordDefaultArgon2Parallelism
+	}
+	if hasher.argon2.SaltLength == 0 {
+		hasher.argon2.SaltLength = passwordDefaultArgon2SaltLength
+	}
+	if hasher.argon2.KeyLength == 0 {
+		hasher.argon2.KeyLength = passwordDefaultArgon2KeyLength
+	}
+	if hasher.bcrypt.Cost == 0 {
+		hasher.bcrypt.Cost = passwordDefaultBcryptCost
+	}
+	if hasher.bcrypt.Cost < bcrypt.MinCost || hasher.bcrypt.Cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("cannot create password hasher: invalid bcrypt cost %d", hasher.bcrypt.Cost)
+	}
+	if config.PepperFilepath != "" {
+		pepper, errGetSecret := GetSecretString(config.PepperFilepath)
+		if errGetSecret != nil {
+			return nil, errGetSecret
+		}
+		if len(pepper) < 16 {
+			return nil, fmt.Errorf("cannot create password hasher: pepper must be at least 16 bytes long")
+		}
+		hasher.pepper = []byte(pepper)
+		pepperHash := sha256.Sum256(hasher.pepper)
+		hasher.pepperId = base64.RawURLEncoding.EncodeToString(pepperHash[:6])
+	}
+	return hasher, nil
+}
+
+// applyPepper returns the password keyed with the pepper through
+// HMAC-SHA256, base64 encoded so it always fits the bcrypt 72 bytes limit
+func (h *PasswordHasher) applyPepper(password string) []byte {
+	if len(h.pepper) == 0 {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// Hash returns the encoded hash of the password with the configured
+// algorithm and parameters
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	now := time.Now()
+	defer func() { log.Tracef("completed PasswordHasher.Hash operation in %s", time.Since(now)) }()
+	if h.algorithm == PASSWORD_ALGORITHM_BCRYPT {
+		hashed, errGenerate := bcrypt.GenerateFromPassword(h.applyPepper(password), h.bcrypt.Cost)
+		if errGenerate != nil {
+			return "", fmt.Errorf("cannot hash provided string: %s", errGenerate.Error())
+		}
+		return string(hashed), nil
+	}
+	salt := make([]byte, h.argon2.SaltLength)
+	if _, errRandRead := rand.Read(salt); errRandRead != nil {
+		return "", fmt.Errorf("cannot create random salt: %s", errRandRead.Error())
+	}
+	key := argon2.IDKey(h.applyPepper(password), salt, h.argon2.Iterations, h.argon2.Memory, h.argon2.Parallelism, h.argon2.KeyLength)
+	return passwordArgon2Hash{
+		version:  argon2.Version,
+		params:   Argon2Params{Memory: h.argon2.Memory, Iterations: h.argon2.Iterations, Parallelism: h.argon2.Parallelism},
+		pepperId: h.pepperId,
+		salt:     salt,
+		key:      key,
+	}.String(), nil
+}
+
+// Verify returns true if the password matches the encoded hash
+func (h *PasswordHasher) Verify(encodedHash string, password string) (bool, error) {
+	valid, _, errVerify := h.verify(encodedHash, password)
+	return valid, errVerify
+}
+
+// verify also reports whether a bcrypt hash matched only without
+// pepper, that is it was created before the pepper was configured
+func (h *PasswordHasher) verify(encodedHash string, password string) (bool, bool, error) {
+	now := time.Now()
+	defer func() { log.Tracef("completed PasswordHasher.Verify operation in %s", time.Since(now)) }()
+	if strings.HasPrefix(encodedHash, "$"+PASSWORD_ALGORITHM_ARGON2ID+"$") {
+		parsed, errParse := passwordParseArgon2Hash(encodedHash)
+		if errParse != nil {
+			return false, false, errParse
+		}
+		input := []byte(password)
+		if parsed.pepperId != "" {
+			if parsed.pepperId != h.pepperId {
+				return false, false, fmt.Errorf("cannot verify password: hash created with unknown pepper %s", parsed.pepperId)
+			}
+			input = h.applyPepper(password)
+		}
+		key := argon2.IDKey(input, parsed.salt, parsed.params.Iterations, parsed.params.Memory, parsed.params.Parallelism, uint32(len(parsed.key)))
+		return subtle.ConstantTimeCompare(key, parsed.key) == 1, false, nil
+	}
+	if _, errCost := bcrypt.Cost([]byte(encodedHash)); errCost != nil {
+		return false, false, fmt.Errorf("cannot verify password: unsupported hash format")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(encodedHash), h.applyPepper(password)) == nil {
+		return true, false, nil
+	}
+	// bcrypt hashes created before the pepper was configured
+	if len(h.pepper) > 0 && bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password)) == nil {
+		return true, true, nil
+	}
+	return false, false, nil
+}
+
+// NeedsRehash returns true if the encoded hash has not been created
+// with the configured algorithm, parameters and pepper
+func (h *PasswordHasher) NeedsRehash(encodedHash string) bool {
+	if strings.HasPrefix(encodedHash, "$"+PASSWORD_ALGORITHM_ARGON2ID+"$") {
+		if h.algorithm != PASSWORD_ALGORITHM_ARGON2ID {
+			return true
+		}
+		parsed, errParse := passwordParseArgon2Hash(encodedHash)
+		if errParse != nil {
+			return true
+		}
+		return parsed.version != argon2.Version ||
+			parsed.params.Memory < h.argon2.Memory ||
+			parsed.params.Iterations < h.argon2.Iterations ||
+			parsed.params.Parallelism != h.argon2.Parallelism ||
+			uint32(len(parsed.salt)) < h.argon2.SaltLength ||
+			uint32(len(parsed.key)) < h.argon2.KeyLength ||
+			parsed.pepperId != h.pepperId
+	}
+	if h.algorithm != PASSWORD_ALGORITHM_BCRYPT {
+		return true
+	}
+	cost, errCost := bcrypt.Cost([]byte(encodedHash))
+	if errCost != nil {
+		return true
+	}
+	return cost < h.bcrypt.Cost
+}
+
+// VerifyAndUpgrade verifies the password and, when it matches and the
+// stored hash is outdated, returns a new hash to be saved in place of
+// the old one. The returned hash is empty if no upgrade is needed
+func (h *PasswordHasher) VerifyAndUpgrade(encodedHash string, password string) (bool, string, error) {
+	valid, unpeppered, errVerify := h.verify(encodedHash, password)
+	if errVerify != nil || !valid {
+		return false, "", errVerify
+	}
+	if !unpeppered && !h.NeedsRehash(encodedHash) {
+		return true, "", nil
+	}
+	upgraded, errHash := h.Hash(password)
+	if errHash != nil {
+		// the login is valid anyway, the upgrade will be retried next time
+		log.WithError(errHash).Warnln("cannot upgrade password hash")
+		return true, "", nil
+	}
+	return true, upgraded, nil
+}
+
+type passwordArgon2Hash struct {
+	version  int
+	params   Argon2Params
+	pepperId string
+	salt     []byte
+	key      []byte
+}
+
+func (a passwordArgon2Hash) String() string {
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", a.params.Memory, a.params.Iterations, a.params.Parallelism)
+	if a.pepperId != "" {
+		params += ",keyid=" + a.pepperId
+	}
+	return fmt.Sprintf("$%s$v=%d$%s$%s$%s",
+		PASSWORD_ALGORITHM_ARGON2ID,
+		a.version,
+		params,
+		base64.RawStdEncoding.EncodeToString(a.salt),
+		base64.RawStdEncoding.EncodeToString(a.key))
+}
+
+func passwordParseArgon2Hash(encodedHash string) (passwordArgon2Hash, error) {
+	var parsed passwordArgon2Hash
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != PASSWORD_ALGORITHM_ARGON2ID {
+		return parsed, fmt.Errorf("cannot parse argon2id hash: invalid format")
+	}
+	if _, errScan := fmt.Sscanf(parts[2], "v=%d", &parsed.version); errScan != nil {
+		return parsed, fmt.Errorf("cannot parse argon2id hash version: %s", errScan.Error())
+	}
+	for _, param := range strings.Split(parts[3], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return parsed, fmt.Errorf("cannot parse argon2id hash: invalid parameter %s", param)
+		}
+		if kv[0] == "keyid" {
+			parsed.pepperId = kv[1]
+			continue
+		}
+		value, errParse := strconv.ParseUint(kv[1], 10, 32)
+		if errParse != nil {
+			return parsed, fmt.Errorf("cannot parse argon2id hash parameter %s: %s", kv[0], errParse.Error())
+		}
+		switch kv[0] {
+		case "m":
+			parsed.params.Memory = uint32(value)
+		case "t":
+			parsed.params.Iterations = uint32(value)
+		case "p":
+			if value > 255 {
+				return parsed, fmt.Errorf("cannot parse argon2id hash: invalid parallelism %d", value)
+			}
+			parsed.params.Parallelism = uint8(value)
+		}
+	}
+	if parsed.params.Memory == 0 || parsed.params.Iterations == 0 || parsed.params.Parallelism == 0 {
+		return parsed, fmt.Errorf("cannot parse argon2id hash: missing parameters")
+	}
+	var errDecode error
+	parsed.salt, errDecode = base64.RawStdEncoding.DecodeString(parts[4])
+	if errDecode != nil {
+		return parsed, fmt.Errorf("cannot decode argon2id salt: %s", errDecode.Error())
+	}
+	parsed.key, errDecode = base64.RawStdEncoding.DecodeString(parts[5])
+	if errDecode != nil || len(parsed.key) == 0 {
+		return parsed, fmt.Errorf("cannot decode argon2id hash")
+	}
+	return parsed, nil
+}
@@ -2,14 +2,135 @@ package api_common
 
 import (
 	"crypto/rand"
-	"encoding/base64"
-	"math/big"
+	"fmt"
+	"io"
+	"math"
 	"strings"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// RANDOM_ALPHABET_* are the predefined alphabets of the random string
+// generators
+const (
+	RANDOM_ALPHABET_DIGITS           = "0123456789"
+	RANDOM_ALPHABET_HEX              = "0123456789abcdef"
+	RANDOM_ALPHABET_BASE32_CROCKFORD = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	RANDOM_ALPHABET_BASE62           = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	RANDOM_ALPHABET_BASE64_URL       = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	RANDOM_ALPHABET_HUMAN_FRIENDLY   = "23456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+const randomGeneratorMaxLength = 1 << 16
+const randomGeneratorBatchMultiplier = 2
+
+// RandomStringGenerator generates uniformly distributed random strings
+// over an alphabet, reading from crypto/rand and using rejection
+// sampling so that every character has the same probability
+type RandomStringGenerator struct {
+	alphabet []byte
+	limit    int
+	reader   io.Reader
+}
+
+// NewRandomStringGenerator returns a generator for the given alphabet,
+// which must contain between 2 and 256 distinct ASCII characters
+func NewRandomStringGenerator(alphabet string) (*RandomStringGenerator, error) {
+	if len(alphabet) < 2 || len(alphabet) > 256 {
+		return nil, fmt.Errorf("cannot create random generator: alphabet must contain between 2 and 256 characters")
+	}
+	seen := map[byte]bool{}
+	for i := 0; i < len(alphabet); i++ {
+		if alphabet[i] > 127 {
+			return nil, fmt.Errorf("cannot create random generator: alphabet must contain only ascii characters")
+		}
+		if seen[alphabet[i]] {
+			return nil, fmt.Errorf("cannot create random generator: duplicated character %q in alphabet", alphabet[i])
+		}
+		seen[alphabet[i]] = true
+	}
+	return &RandomStringGenerator{
+		alphabet: []byte(alphabet),
+		// bytes greater or equal to limit are rejected to avoid modulo bias
+		limit:  256 - 256%len(alphabet),
+		reader: rand.Reader,
+	}, nil
+}
+
+// EntropyBits returns the entropy of a string of the given length
+func (g *RandomStringGenerator) EntropyBits(length int) float64 {
+	return float64(length) * math.Log2(float64(len(g.alphabet)))
+}
+
+// LengthForEntropy returns the minimum length giving at least the
+// requested bits of entropy
+func (g *RandomStringGenerator) LengthForEntropy(bits int) int {
+	return int(math.Ceil(float64(bits) / math.Log2(float64(len(g.alphabet)))))
+}
+
+// Generate returns a random string of exactly length characters
+func (g *RandomStringGenerator) Generate(length int) (string, error) {
+	if length <= 0 || length > randomGeneratorMaxLength {
+		return "", fmt.Errorf("cannot generate random string: invalid length %d", length)
+	}
+	out := make([]byte, 0, length)
+	buffer := make([]byte, length*randomGeneratorBatchMultiplier)
+	for len(out) < length {
+		if _, err := io.ReadFull(g.reader, buffer); err != nil {
+			return "", fmt.Errorf("cannot read random bytes: %s", err.Error())
+		}
+		for _, b := range buffer {
+			if int(b) >= g.limit {
+				continue
+			}
+			out = append(out, g.alphabet[int(b)%len(g.alphabet)])
+			if len(out) == length {
+				break
+			}
+		}
+	}
+	return string(out), nil
+}
+
+// GenerateWithEntropy returns a random string with at least the
+// requested bits of entropy
+func (g *RandomStringGenerator) GenerateWithEntropy(bits int) (string, error) {
+	if bits <= 0 {
+		return "", fmt.Errorf("cannot generate random string: invalid entropy %d", bits)
+	}
+	return g.Generate(g.LengthForEntropy(bits))
+}
+
+// RandomGenerateString returns a random string of the given length over
+// the given alphabet, e.g. RANDOM_ALPHABET_BASE62 or a custom one
+func RandomGenerateString(alphabet string, length int) (string, error) {
+	generator, err := NewRandomStringGenerator(alphabet)
+	if err != nil {
+		return "", err
+	}
+	return generator.Generate(length)
+}
+
+// RandomGenerateHumanFriendly returns a random string without
+// confusable characters (0/O, 1/I/L, U/V), grouped by groupSize
+// characters separated by hyphens if groupSize is greater than 0
+func RandomGenerateHumanFriendly(length int, groupSize int) (string, error) {
+	out, err := RandomGenerateString(RANDOM_ALPHABET_HUMAN_FRIENDLY, length)
+	if err != nil || groupSize <= 0 {
+		return out, err
+	}
+	groups := make([]string, 0, length/groupSize+1)
+	for i := 0; i < len(out); i += groupSize {
+		end := i + groupSize
+		if end > len(out) {
+			end = len(out)
+		}
+		groups = append(groups, out[i:end])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
 // RandomGenerateUuid generates a random string identifier
 // including (or not) hypens
 func RandomGenerateUuid(withHyphen bool) string {
@@ -20,33 +141,59 @@ func RandomGenerateUuid(withHyphen bool) string {
 	return id.String()
 }
 
+// RandomGenerateUuidString generates a random string identifier
+// including (or not) hypens, with the given length. Lengths greater
+// than a single uuid are filled with further uuids
+func RandomGenerateUuidString(withHyphen bool, length int) (string, error) {
+	if length <= 0 {
+		return "", nil
+	}
+	out := ""
+	for len(out) < length {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return "", fmt.Errorf("cannot generate random uuid: %s", err.Error())
+		}
+		out += TernaryOperator(withHyphen, id.String(), strings.Replace(id.String(), "-", "", -1)).(string)
+	}
+	return out[:length], nil
+}
+
 // RandomGenerateUuidWithLength generates a random string identifier
-// including (or not) hypens, with max length
+// including (or not) hypens, with max length. It returns an empty
+// string if the random source fails.
+//
+// Deprecated: use RandomGenerateUuidString, which returns the error
 func RandomGenerateUuidWithLength(withHyphen bool, length int) string {
-	out := RandomGenerateUuid(withHyphen)
-	return out[:length]
+	out, err := RandomGenerateUuidString(withHyphen, length)
+	if err != nil {
+		log.WithError(err).Errorln("cannot generate random uuid string")
+		return ""
+	}
+	return out
 }
 
-// RandomGenerateToken generates a random string of the given length
+// RandomGenerateToken generates a random URL-safe string of the given
+// length, each character carrying exactly 6 bits of entropy
 func RandomGenerateToken(length int) (string, error) {
-	bytes := make([]byte, length)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return base64.URLEncoding.EncodeToString(bytes)[:length], nil
+	return RandomGenerateString(RANDOM_ALPHABET_BASE64_URL, length)
+}
+
+// RandomGenerateDigits generates a random string of the given length
+// with only digits, e.g. a one-time code
+func RandomGenerateDigits(length int) (string, error) {
+	return RandomGenerateString(RANDOM_ALPHABET_DIGITS, length)
 }
 
 // RandomGenerateNumeric generates a random string of the given length
-// with only digits
+// with only digits. It returns an empty string if the random source fails.
+//
+// Deprecated: use RandomGenerateDigits, which returns the error
 func RandomGenerateNumeric(length int) string {
-	pin := ""
-	for i := 0; i < length; i++ {
-		n, err := rand.Int(rand.Reader, big.NewInt(9))
-		if err != nil {
-			log.WithError(err).Errorln("BIG PROBLEMS IN RANDOM STUFF")
-			n = big.NewInt(1)
-		}
-		pin += n.String()
+	pin, err := RandomGenerateDigits(length)
+	if err != nil {
+		log.WithError(err).Errorln("cannot generate random numeric string")
+		return ""
 	}
 	return pin
 }
@@ -0,0 +1,448 @@
+package api_common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// REDACTION_ACTION_MASK replaces the value with REDACTION_MASK,
+// REDACTION_ACTION_REMOVE removes the key, REDACTION_ACTION_EMAIL keeps the
+// first character and the domain of an email, REDACTION_ACTION_PARTIAL
+// keeps the first and last two characters and REDACTION_ACTION_HASH
+// replaces the value with a short sha256, so that equal values can still
+// be correlated
+const REDACTION_ACTION_MASK = "mask"
+const REDACTION_ACTION_REMOVE = "remove"
+const REDACTION_ACTION_EMAIL = "email"
+const REDACTION_ACTION_PARTIAL = "partial"
+const REDACTION_ACTION_HASH = "hash"
+
+const REDACTION_MASK = "***"
+
+// DefaultRedactionRules masks the credentials and the emails
+var DefaultRedactionRules = []RedactionRule{
+	{
+		Name:   "credentials",
+		Keys:   []string{"access_token", "refresh_token", "id_token", "token", "password", "new_password", "old_password", "secret", "client_secret", "authorization", "cookie", "otp", "code", "recovery_codes"},
+		Action: REDACTION_ACTION_MASK,
+	},
+	{
+		Name:   "emails",
+		Keys:   []string{"email"},
+		Action: REDACTION_ACTION_EMAIL,
+	},
+}
+
+type redactionPathSegment struct {
+	key      string
+	index    int
+	anyKey   bool
+	anyIndex bool
+}
+
+type redactionCompiledRule struct {
+	keys   map[string]bool
+	paths  [][]redactionPathSegment
+	action string
+}
+
+// Redactor applies redaction rules to JSON payloads and log fields. Key
+// rules match a key name, case insensitive, at any depth; path rules
+// match a JSON path like $.data.user.email, where * matches any key and
+// [*] any array index
+type Redactor struct {
+	rules []redactionCompiledRule
+}
+
+// NewRedactor validates and compiles the rules
+func NewRedactor(rules []RedactionRule) (*Redactor, error) {
+	redactor := &Redactor{}
+	for _, rule := range rules {
+		compiled := redactionCompiledRule{keys: map[string]bool{}, action: rule.Action}
+		switch rule.Action {
+		case "":
+			compiled.action = REDACTION_ACTION_MASK
+		case REDACTION_ACTION_MASK, REDACTION_ACTION_REMOVE, REDACTION_ACTION_EMAIL, REDACTION_ACTION_PARTIAL, REDACTION_ACTION_HASH:
+		default:
+			return nil, fmt.Errorf("redaction rule %s: unknown action %s", rule.Name, rule.Action)
+		}
+		for _, key := range rule.Keys {
+			compiled.keys[strings.ToLower(key)] = true
+		}
+		for _, path := range rule.Paths {
+			segments, err := compileRedactionPath(path)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %s: %s", rule.Name, err.Error())
+			}
+			compiled.paths = append(compiled.paths, segments)
+		}
+		redactor.rules = append(redactor.rules, compiled)
+	}
+	return redactor, nil
+}
+
+// GetRedactorFromConfig returns a Redactor with the rules of the config
+// and of its RulesFilepath, or DefaultRedactionRules if there are none
+func GetRedactorFromConfig(serviceConfig MicroserviceConfiguration) (*Redactor, error) {
+	redaction := serviceConfig.Application.Redaction
+	rules := append([]RedactionRule{}, redaction.Rules...)
+	if redaction.RulesFilepath != "" {
+		fileRules, err := LoadRedactionRules(redaction.RulesFilepath)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	if len(rules) == 0 {
+		rules = DefaultRedactionRules
+	}
+	return NewRedactor(rules)
+}
+
+// LoadRedactionRules reads a YAML file with the rules under "rules"
+func LoadRedactionRules(filepath string) ([]RedactionRule, error) {
+	content, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read redaction rules %s: %s", filepath, err.Error())
+	}
+	return ParseRedactionRules(content)
+}
+
+// ParseRedactionRules parses YAML rules, e.g.
+//
+//	rules:
+//	  - name: tokens
+//	    keys: [access_token, refresh_token]
+//	    action: mask
+//	  - name: user email
+//	    paths: ["$.data.users[*].email"]
+//	    action: email
+func ParseRedactionRules(content []byte) ([]RedactionRule, error) {
+	var ruleSet struct {
+		Rules []RedactionRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(content, &ruleSet); err != nil {
+		return nil, fmt.Errorf("cannot parse redaction rules: %s", err.Error())
+	}
+	return ruleSet.Rules, nil
+}
+
+func compileRedactionPath(path string) ([]redactionPathSegment, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path %s must start with $", path)
+	}
+	var segments []redactionPathSegment
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty key in path %s", path)
+			}
+			segments = append(segments, redactionPathSegment{key: key, index: -1, anyKey: key == "*"})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in path %s", path)
+			}
+			index := rest[1:end]
+			if index == "*" {
+				segments = append(segments, redactionPathSegment{index: -1, anyIndex: true})
+			} else {
+				n, err := strconv.Atoi(index)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index %s in path %s", index, path)
+				}
+				segments = append(segments, redactionPathSegment{index: n})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %s", path)
+		}
+	}
+	return segments, nil
+}
+
+// redactionPathElement is a key, or an index if key is empty
+type redactionPathElement struct {
+	key   string
+	index int
+}
+
+func redactionPathMatches(pattern []redactionPathSegment, path []redactionPathElement) bool {
+	if len(pattern) != len(path) {
+		return false
+	}
+	for i, segment := range pattern {
+		element := path[i]
+		isIndex := element.key == "" && element.index >= 0
+		switch {
+		case segment.anyKey:
+			if isIndex {
+				return false
+			}
+		case segment.anyIndex:
+			if !isIndex {
+				return false
+			}
+		case segment.key != "":
+			if segment.key != element.key {
+				return false
+			}
+		default:
+			if !isIndex || segment.index != element.index {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// action returns the action of the first rule matching the key or path
+func (r *Redactor) action(key string, path []redactionPathElement) (string, bool) {
+	lowerKey := strings.ToLower(key)
+	for _, rule := range r.rules {
+		if key != "" && rule.keys[lowerKey] {
+			return rule.action, true
+		}
+		for _, pattern := range rule.paths {
+			if redactionPathMatches(pattern, path) {
+				return rule.action, true
+			}
+		}
+	}
+	return "", false
+}
+
+func redactString(action string, value string) string {
+	switch action {
+	case REDACTION_ACTION_EMAIL:
+		at := strings.LastIndexByte(value, '@')
+		if at <= 0 {
+			return REDACTION_MASK
+		}
+		// the first character may be multibyte
+		_, size := utf8.DecodeRuneInString(value)
+		return value[:size] + REDACTION_MASK + value[at:]
+	case REDACTION_ACTION_PARTIAL:
+		runes := []rune(value)
+		if len(runes) <= 8 {
+			return REDACTION_MASK
+		}
+		return string(runes[:2]) + REDACTION_MASK + string(runes[len(runes)-2:])
+	case REDACTION_ACTION_HASH:
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	return REDACTION_MASK
+}
+
+func redactAny(action string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if str, ok := value.(string); ok {
+		return redactString(action, str)
+	}
+	if action == REDACTION_ACTION_HASH {
+		return redactString(action, fmt.Sprint(value))
+	}
+	return REDACTION_MASK
+}
+
+func (r *Redactor) walk(value interface{}, path []redactionPathElement) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			childPath := append(path[:len(path):len(path)], redactionPathElement{key: key, index: -1})
+			if action, ok := r.action(key, childPath); ok {
+				if action == REDACTION_ACTION_REMOVE {
+					delete(typed, key)
+				} else {
+					typed[key] = redactAny(action, child)
+				}
+				continue
+			}
+			typed[key] = r.walk(child, childPath)
+		}
+	case []interface{}:
+		for i, child := range typed {
+			childPath := append(path[:len(path):len(path)], redactionPathElement{index: i})
+			if action, ok := r.action("", childPath); ok {
+				typed[i] = TernaryOperator(action == REDACTION_ACTION_REMOVE, nil, redactAny(action, child))
+				continue
+			}
+			typed[i] = r.walk(child, childPath)
+		}
+	}
+	return value
+}
+
+// RedactValue redacts a decoded JSON value, modifying maps and slices in place
+func (r *Redactor) RedactValue(value interface{}) interface{} {
+	if r == nil {
+		return value
+	}
+	return r.walk(value, nil)
+}
+
+// RedactJSON redacts a JSON document. Payloads that are not a single
+// JSON value cannot be inspected, so they are replaced by REDACTION_MASK
+func (r *Redactor) RedactJSON(payload []byte) []byte {
+	if r == nil || len(r.rules) == 0 || len(bytes.TrimSpace(payload)) == 0 {
+		return payload
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return []byte(REDACTION_MASK)
+	}
+	redacted, err := json.Marshal(r.walk(value, nil))
+	if err != nil {
+		return []byte(REDACTION_MASK)
+	}
+	return redacted
+}
+
+// RedactBody redacts a JSON or form encoded body, by its content type.
+// Any other body, e.g. text or multipart, is replaced by REDACTION_MASK
+// unless it is JSON
+func (r *Redactor) RedactBody(contentType string, body []byte) string {
+	if r == nil || len(r.rules) == 0 {
+		return string(body)
+	}
+	if strings.HasPrefix(contentType, fiber.MIMEMultipartForm) {
+		return TernaryOperator(len(body) == 0, "", REDACTION_MASK).(string)
+	}
+	if strings.HasPrefix(contentType, fiber.MIMEApplicationForm) {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return REDACTION_MASK
+		}
+		for key := range values {
+			if action, ok := r.action(key, []redactionPathElement{{key: key, index: -1}}); ok {
+				if action == REDACTION_ACTION_REMOVE {
+					values.Del(key)
+					continue
+				}
+				for i, value := range values[key] {
+					values[key][i] = redactString(action, value)
+				}
+			}
+		}
+		return values.Encode()
+	}
+	return string(r.RedactJSON(body))
+}
+
+// RedactFields redacts log fields by key name, and the maps among their values
+func (r *Redactor) RedactFields(fields log.Fields) log.Fields {
+	if r == nil {
+		return fields
+	}
+	redacted := make(log.Fields, len(fields))
+	for key, value := range fields {
+		if action, ok := r.action(key, []redactionPathElement{{key: key, index: -1}}); ok {
+			if action != REDACTION_ACTION_REMOVE {
+				redacted[key] = redactAny(action, value)
+			}
+			continue
+		}
+		if m, ok := value.(map[string]interface{}); ok {
+			// the caller's map is left untouched
+			value = r.walk(redactionCopy(m), []redactionPathElement{{key: key, index: -1}})
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+
+func redactionCopy(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typed))
+		for key, child := range typed {
+			copied[key] = redactionCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(typed))
+		for i, child := range typed {
+			copied[i] = redactionCopy(child)
+		}
+		return copied
+	}
+	return value
+}
+
+var redactor atomic.Value
+
+func init() {
+	defaultRedactor, _ := NewRedactor(DefaultRedactionRules)
+	redactor.Store(defaultRedactor)
+}
+
+// SetRedactor replaces the redactor used for the monitor payloads and
+// the logs; nil disables the redaction
+func SetRedactor(r *Redactor) {
+	if r == nil {
+		r = &Redactor{}
+	}
+	redactor.Store(r)
+}
+
+// GetRedactor returns the redactor set with SetRedactor, by default
+// with DefaultRedactionRules
+func GetRedactor() *Redactor {
+	return redactor.Load().(*Redactor)
+}
+
+// RedactionHook is a logrus hook redacting the fields of every entry,
+// including those added by Elog and by the callers
+type RedactionHook struct{}
+
+func (RedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (RedactionHook) Fire(entry *log.Entry) error {
+	entry.Data = GetRedactor().RedactFields(entry.Data)
+	return nil
+}
+
+// BodyLoggingMiddleware logs the redacted request and response bodies at
+// debug level
+func BodyLoggingMiddleware() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if !log.IsLevelEnabled(log.DebugLevel) {
+			return c.Next()
+		}
+		r := GetRedactor()
+		Elog(c).WithField("body", r.RedactBody(string(c.Request().Header.ContentType()), c.Body())).
+			Debugf("request %s %s", c.Method(), c.OriginalURL())
+		errNext := c.Next()
+		Elog(c).WithField("body", r.RedactBody(string(c.Response().Header.ContentType()), c.Response().Body())).
+			Debugf("response %d", c.Response().StatusCode())
+		return errNext
+	}
+}
@@ -0,0 +1,230 @@
+package api_common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []RedactionRule
+		payload  string
+		expected string
+	}{
+		{
+			name:     "key rule at any depth, case insensitive",
+			rules:    []RedactionRule{{Name: "secrets", Keys: []string{"password"}}},
+			payload:  `{"Password":"x","data":{"user":{"password":"y","name":"n"}}}`,
+			expected: `{"Password":"***","data":{"user":{"name":"n","password":"***"}}}`,
+		},
+		{
+			name:     "key rule inside arrays",
+			rules:    []RedactionRule{{Name: "secrets", Keys: []string{"token"}}},
+			payload:  `{"sessions":[{"token":"a"},{"token":"b"}]}`,
+			expected: `{"sessions":[{"token":"***"},{"token":"***"}]}`,
+		},
+		{
+			name:     "path rule with any index",
+			rules:    []RedactionRule{{Name: "emails", Paths: []string{"$.data.users[*].email"}, Action: REDACTION_ACTION_EMAIL}},
+			payload:  `{"data":{"users":[{"email":"alice@example.com"},{"email":"bob@example.com"}]},"email":"kept@example.com"}`,
+			expected: `{"data":{"users":[{"email":"a***@example.com"},{"email":"b***@example.com"}]},"email":"kept@example.com"}`,
+		},
+		{
+			name:     "path rule with any key",
+			rules:    []RedactionRule{{Name: "ibans", Paths: []string{"$.accounts.*.iban"}, Action: REDACTION_ACTION_PARTIAL}},
+			payload:  `{"accounts":{"main":{"iban":"IT60X0542811101000000123456"},"other":{"iban":"short"}}}`,
+			expected: `{"accounts":{"main":{"iban":"IT***56"},"other":{"iban":"***"}}}`,
+		},
+		{
+			name:     "path rule with fixed index",
+			rules:    []RedactionRule{{Name: "first", Paths: []string{"$.items[0]"}}},
+			payload:  `{"items":["a","b"]}`,
+			expected: `{"items":["***","b"]}`,
+		},
+		{
+			name:     "remove action",
+			rules:    []RedactionRule{{Name: "cookies", Keys: []string{"cookie"}, Action: REDACTION_ACTION_REMOVE}},
+			payload:  `{"cookie":"c","path":"/"}`,
+			expected: `{"path":"/"}`,
+		},
+		{
+			name:     "remove action on array element",
+			rules:    []RedactionRule{{Name: "second", Paths: []string{"$.items[1]"}, Action: REDACTION_ACTION_REMOVE}},
+			payload:  `{"items":["a","b"]}`,
+			expected: `{"items":["a",null]}`,
+		},
+		{
+			name:     "email action with multibyte first character",
+			rules:    []RedactionRule{{Name: "emails", Keys: []string{"email"}, Action: REDACTION_ACTION_EMAIL}},
+			payload:  `{"email":"élodie@example.com"}`,
+			expected: `{"email":"é***@example.com"}`,
+		},
+		{
+			name:     "email action without domain",
+			rules:    []RedactionRule{{Name: "emails", Keys: []string{"email"}, Action: REDACTION_ACTION_EMAIL}},
+			payload:  `{"email":"not an email"}`,
+			expected: `{"email":"***"}`,
+		},
+		{
+			name:     "partial action with multibyte characters",
+			rules:    []RedactionRule{{Name: "names", Keys: []string{"name"}, Action: REDACTION_ACTION_PARTIAL}},
+			payload:  `{"name":"ßéñøœ∂ƒ©˙∆"}`,
+			expected: `{"name":"ßé***˙∆"}`,
+		},
+		{
+			name:     "non string values are masked",
+			rules:    []RedactionRule{{Name: "pins", Keys: []string{"pin"}}},
+			payload:  `{"pin":1234,"count":12345678901234567890}`,
+			expected: `{"count":12345678901234567890,"pin":"***"}`,
+		},
+		{
+			name:     "not json is masked",
+			rules:    DefaultRedactionRules,
+			payload:  `password=x`,
+			expected: REDACTION_MASK,
+		},
+		{
+			name:     "multiple json values are masked",
+			rules:    DefaultRedactionRules,
+			payload:  `{"a":1} {"password":"x"}`,
+			expected: REDACTION_MASK,
+		},
+		{
+			name:     "empty payload is unchanged",
+			rules:    DefaultRedactionRules,
+			payload:  ``,
+			expected: ``,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redactor, err := NewRedactor(test.rules)
+			if err != nil {
+				t.Fatalf("cannot create redactor: %s", err.Error())
+			}
+			if redacted := string(redactor.RedactJSON([]byte(test.payload))); redacted != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, redacted)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	redactor, err := NewRedactor(DefaultRedactionRules)
+	if err != nil {
+		t.Fatalf("cannot create redactor: %s", err.Error())
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "password=x&user=u", expected: "password=%2A%2A%2A&user=u"},
+		{name: "json", contentType: "application/json", body: `{"password":"x"}`, expected: `{"password":"***"}`},
+		{name: "text", contentType: "text/plain", body: "password=x", expected: REDACTION_MASK},
+		{name: "multipart", contentType: "multipart/form-data; boundary=b", body: "--b\r\nContent-Disposition: form-data; name=\"password\"\r\n\r\nx\r\n--b--", expected: REDACTION_MASK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if redacted := redactor.RedactBody(test.contentType, []byte(test.body)); redacted != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, redacted)
+			}
+		})
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	redactor, err := NewRedactor([]RedactionRule{{Name: "ids", Keys: []string{"id"}, Action: REDACTION_ACTION_HASH}})
+	if err != nil {
+		t.Fatalf("cannot create redactor: %s", err.Error())
+	}
+	first := string(redactor.RedactJSON([]byte(`{"id":"abc"}`)))
+	second := string(redactor.RedactJSON([]byte(`{"id":"abc"}`)))
+	if first != second || !strings.Contains(first, `"sha256:`) || strings.Contains(first, "abc") {
+		t.Errorf("expected equal sha256 values, got %s and %s", first, second)
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	redactor, err := NewRedactor(DefaultRedactionRules)
+	if err != nil {
+		t.Fatalf("cannot create redactor: %s", err.Error())
+	}
+	user := map[string]interface{}{"email": "alice@example.com"}
+	redacted := redactor.RedactFields(map[string]interface{}{"token": "t", "user": user})
+	if redacted["token"] != REDACTION_MASK {
+		t.Errorf("expected masked token, got %v", redacted["token"])
+	}
+	if email := redacted["user"].(map[string]interface{})["email"]; email != "a***@example.com" {
+		t.Errorf("expected redacted email, got %v", email)
+	}
+	if user["email"] != "alice@example.com" {
+		t.Errorf("expected the caller's map untouched, got %v", user["email"])
+	}
+}
+
+func TestNewRedactor(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []RedactionRule
+		valid bool
+	}{
+		{name: "default action", rules: []RedactionRule{{Name: "r", Keys: []string{"k"}}}, valid: true},
+		{name: "every action", rules: []RedactionRule{
+			{Name: "mask", Keys: []string{"a"}, Action: REDACTION_ACTION_MASK},
+			{Name: "remove", Keys: []string{"b"}, Action: REDACTION_ACTION_REMOVE},
+			{Name: "email", Keys: []string{"c"}, Action: REDACTION_ACTION_EMAIL},
+			{Name: "partial", Keys: []string{"d"}, Action: REDACTION_ACTION_PARTIAL},
+			{Name: "hash", Keys: []string{"e"}, Action: REDACTION_ACTION_HASH},
+		}, valid: true},
+		{name: "valid paths", rules: []RedactionRule{{Name: "r", Paths: []string{"$.a.b", "$.a[*].b", "$.*.b[0]", "$[1]"}}}, valid: true},
+		{name: "unknown action", rules: []RedactionRule{{Name: "r", Keys: []string{"k"}, Action: "encrypt"}}},
+		{name: "path without $", rules: []RedactionRule{{Name: "r", Paths: []string{"a.b"}}}},
+		{name: "path with empty key", rules: []RedactionRule{{Name: "r", Paths: []string{"$..b"}}}},
+		{name: "path with unclosed index", rules: []RedactionRule{{Name: "r", Paths: []string{"$.a[0"}}}},
+		{name: "path with invalid index", rules: []RedactionRule{{Name: "r", Paths: []string{"$.a[-1]"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewRedactor(test.rules)
+			if test.valid && err != nil {
+				t.Errorf("expected valid rules, got %s", err.Error())
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseRedactionRules(t *testing.T) {
+	rules, err := ParseRedactionRules([]byte(`
+rules:
+  - name: tokens
+    keys: [access_token, refresh_token]
+    action: mask
+  - name: user email
+    paths: ["$.data.users[*].email"]
+    action: email
+`))
+	if err != nil {
+		t.Fatalf("cannot parse rules: %s", err.Error())
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	if rules[0].Name != "tokens" || len(rules[0].Keys) != 2 || rules[0].Keys[1] != "refresh_token" || rules[0].Action != REDACTION_ACTION_MASK {
+		t.Errorf("unexpected first rule %+v", rules[0])
+	}
+	if rules[1].Name != "user email" || len(rules[1].Paths) != 1 || rules[1].Paths[0] != "$.data.users[*].email" || rules[1].Action != REDACTION_ACTION_EMAIL {
+		t.Errorf("unexpected second rule %+v", rules[1])
+	}
+	if _, err = NewRedactor(rules); err != nil {
+		t.Errorf("cannot create redactor from parsed rules: %s", err.Error())
+	}
+	if _, err = ParseRedactionRules([]byte("rules: [")); err == nil {
+		t.Errorf("expected an error for invalid yaml")
+	}
+}
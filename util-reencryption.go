@@ -0,0 +1,211 @@
+package api_common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReEncryptionProgress stores the position reached by a ReEncryptionJob
+// on a given table, so that an interrupted job can be resumed
+type ReEncryptionProgress struct {
+	JobName    string    `gorm:"primaryKey;size:191"`
+	LastKey    string    `gorm:"size:191"`
+	Scanned    int64     `gorm:"not null;default:0"`
+	Migrated   int64     `gorm:"not null;default:0"`
+	Completed  bool      `gorm:"not null;default:false"`
+	UpdatedAt  time.Time `gorm:"autoUpdateTime"`
+	StartedAt  time.Time
+	FinishedAt *time.Time
+}
+
+// TableName sets the table used to persist the re-encryption progress
+func (ReEncryptionProgress) TableName() string {
+	return "crypto_reencryption_progress"
+}
+
+// ReEncryptionJob migrates the encrypted columns of a table to the
+// primary key of the keyring, processing rows in chunks ordered by
+// primary key and saving the progress after every chunk
+type ReEncryptionJob struct {
+	DB         *gorm.DB
+	Keyring    *CryptoKeyring
+	Table      string
+	PrimaryKey string
+	Columns    []string
+	ChunkSize  int
+	// Pause is waited between chunks to limit the load on the database
+	Pause time.Duration
+	// AAD returns the additional authenticated data the column of row
+	// has been encrypted with, nil if none. The row holds the primary
+	// key and the Columns
+	AAD func(row map[string]interface{}, column string) []byte
+}
+
+// Name returns the name used to store the job progress. It includes the
+// primary key id, so that the job runs again after every key rotation
+func (j *ReEncryptionJob) Name() string {
+	primary := ""
+	if j.Keyring != nil {
+		primary = j.Keyring.Primary()
+	}
+	return fmt.Sprintf("%s.%s.%s", j.Table, j.PrimaryKey, primary)
+}
+
+// Reset deletes the saved progress, so that the next Run restarts
+// from the first row
+func (j *ReEncryptionJob) Reset(ctx context.Context) error {
+	err := j.DB.WithContext(ctx).Delete(&ReEncryptionProgress{JobName: j.Name()}).Error
+	if err != nil {
+		return fmt.Errorf("cannot reset re-encryption progress for %s: %s", j.Name(), err.Error())
+	}
+	return nil
+}
+
+// Run executes the job until every row has been processed or the
+// context is cancelled. It can be called again to resume the job
+func (j *ReEncryptionJob) Run(ctx context.Context) (ReEncryptionProgress, error) {
+	if j.DB == nil || j.Keyring == nil {
+		return ReEncryptionProgress{}, fmt.Errorf("cannot run re-encryption job: missing database or keyring")
+	}
+	if j.Table == "" || j.PrimaryKey == "" || len(j.Columns) == 0 {
+		return ReEncryptionProgress{}, fmt.Errorf("cannot run re-encryption job: missing table, primary key or columns")
+	}
+	chunkSize := j.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 500
+	}
+	db := j.DB.WithContext(ctx)
+	if errMigrate := db.AutoMigrate(&ReEncryptionProgress{}); errMigrate != nil {
+		return ReEncryptionProgress{}, fmt.Errorf("cannot migrate re-encryption progress table: %s", errMigrate.Error())
+	}
+	progress := ReEncryptionProgress{JobName: j.Name()}
+	errFind := db.Where(&ReEncryptionProgress{JobName: j.Name()}).
+		Attrs(ReEncryptionProgress{StartedAt: time.Now().UTC()}).
+		FirstOrCreate(&progress).Error
+	if errFind != nil {
+		return progress, fmt.Errorf("cannot load re-encryption progress for %s: %s", j.Name(), errFind.Error())
+	}
+	if progress.Completed {
+		log.Infof("re-encryption job %s already completed", j.Name())
+		return progress, nil
+	}
+	log.Infof("re-encryption job %s started from key %q to primary key id %s", j.Name(), progress.LastKey, j.Keyring.Primary())
+
+	for {
+		if errCtx := ctx.Err(); errCtx != nil {
+			return progress, errCtx
+		}
+		done, errChunk := j.runChunk(ctx, &progress, chunkSize)
+		if errChunk != nil {
+			return progress, errChunk
+		}
+		if done {
+			log.Infof("re-encryption job %s completed: %d rows scanned, %d values migrated", j.Name(), progress.Scanned, progress.Migrated)
+			return progress, nil
+		}
+		if j.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return progress, ctx.Err()
+			case <-time.After(j.Pause):
+			}
+		}
+	}
+}
+
+func (j *ReEncryptionJob) runChunk(ctx context.Context, progress *ReEncryptionProgress, chunkSize int) (bool, error) {
+	var rows []map[string]interface{}
+	query := j.DB.WithContext(ctx).Table(j.Table).
+		Select(append([]string{j.PrimaryKey}, j.Columns...)).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: j.PrimaryKey}}).
+		Limit(chunkSize)
+	if progress.LastKey != "" {
+		query = query.Where(clause.Gt{Column: clause.Column{Name: j.PrimaryKey}, Value: progress.LastKey})
+	}
+	if errFind := query.Find(&rows).Error; errFind != nil {
+		return false, fmt.Errorf("cannot read chunk of %s: %s", j.Table, errFind.Error())
+	}
+
+	next := *progress
+	errTransaction := j.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			pk := row[j.PrimaryKey]
+			updates := map[string]interface{}{}
+			conditions := clause.Eq{Column: clause.Column{Name: j.PrimaryKey}, Value: pk}
+			where := []clause.Expression{conditions}
+			for _, column := range j.Columns {
+				value, isString := reEncryptionValueString(row[column])
+				if !isString || value == "" {
+					continue
+				}
+				var aad []byte
+				if j.AAD != nil {
+					aad = j.AAD(row, column)
+				}
+				reEncrypted, changed, errReEncrypt := j.Keyring.ReEncryptWithAAD(value, aad)
+				if errReEncrypt != nil {
+					return fmt.Errorf("cannot re-encrypt %s.%s for %s=%v: %s", j.Table, column, j.PrimaryKey, pk, errReEncrypt.Error())
+				}
+				if changed {
+					updates[column] = reEncrypted
+					// avoid overwriting values concurrently modified by the application
+					where = append(where, clause.Eq{Column: clause.Column{Name: column}, Value: value})
+				}
+			}
+			next.Scanned++
+			next.LastKey = fmt.Sprintf("%v", reEncryptionValueOrRaw(pk))
+			if len(updates) == 0 {
+				continue
+			}
+			result := tx.Table(j.Table).Clauses(clause.Where{Exprs: where}).Updates(updates)
+			if result.Error != nil {
+				return fmt.Errorf("cannot update %s for %s=%v: %s", j.Table, j.PrimaryKey, pk, result.Error.Error())
+			}
+			if result.RowsAffected == 0 {
+				log.Warnf("re-encryption of %s for %s=%v skipped: row changed concurrently", j.Table, j.PrimaryKey, pk)
+				continue
+			}
+			next.Migrated += int64(len(updates))
+		}
+		if len(rows) < chunkSize {
+			now := time.Now().UTC()
+			next.Completed = true
+			next.FinishedAt = &now
+		}
+		return tx.Save(&next).Error
+	})
+	if errTransaction != nil {
+		return false, errTransaction
+	}
+	*progress = next
+	log.Debugf("re-encryption job %s processed chunk up to key %s", j.Name(), progress.LastKey)
+	return progress.Completed, nil
+}
+
+func reEncryptionValueString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	case *string:
+		if v == nil {
+			return "", false
+		}
+		return *v, true
+	default:
+		return "", false
+	}
+}
+
+func reEncryptionValueOrRaw(value interface{}) interface{} {
+	if s, isString := reEncryptionValueString(value); isString {
+		return s
+	}
+	return value
+}
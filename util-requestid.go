@@ -0,0 +1,138 @@
+package api_common
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const requestIdDefaultMaxLength = 64
+const requestIdDefaultMinLength = 8
+
+var requestIdRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+type requestIdContextKey struct{}
+
+// RequestIdConfig configures RequestIdMiddleware
+type RequestIdConfig struct {
+	// Generator generates the id when the request has none or it is not
+	// valid. If nil a random 24 characters id is generated
+	Generator func() string
+	// MinLength and MaxLength bound the length of an accepted inbound id,
+	// by default 8 and 64
+	MinLength int
+	MaxLength int
+}
+
+// ContextWithRequestId returns a context carrying the request id
+func ContextWithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey{}, requestId)
+}
+
+// RequestIdFromContext returns the request id carried by ctx
+func RequestIdFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	requestId, ok := ctx.Value(requestIdContextKey{}).(string)
+	return requestId, ok && requestId != ""
+}
+
+// IsValidRequestId returns true if the id respects the given length
+// bounds and contains only letters, digits, '.', '_', ':' and '-'
+func IsValidRequestId(requestId string, minLength int, maxLength int) bool {
+	return len(requestId) >= minLength && len(requestId) <= maxLength && requestIdRegex.MatchString(requestId)
+}
+
+// RequestIdMiddleware reuses the X-Request-ID of the inbound request if
+// valid, generating a new one otherwise. The id is echoed in the
+// response, stored in the CTX_REQUESTID local and in the user context
+func RequestIdMiddleware(config RequestIdConfig) func(c *fiber.Ctx) error {
+	if config.Generator == nil {
+		config.Generator = func() string {
+			requestId, err := RandomGenerateUuidString(false, 24)
+			if err != nil {
+				log.WithError(err).Errorln("cannot generate request id")
+			}
+			return requestId
+		}
+	}
+	if config.MinLength <= 0 {
+		config.MinLength = requestIdDefaultMinLength
+	}
+	if config.MaxLength <= 0 {
+		config.MaxLength = requestIdDefaultMaxLength
+	}
+	return func(c *fiber.Ctx) error {
+		requestId := c.Get(HTTP_HEADER_REQUEST_ID)
+		if requestId != "" && !IsValidRequestId(requestId, config.MinLength, config.MaxLength) {
+			log.WithField("length", len(requestId)).Debugf("discarding invalid inbound request id")
+			requestId = ""
+		}
+		if requestId == "" {
+			requestId = config.Generator()
+		}
+		c.Set(HTTP_HEADER_REQUEST_ID, requestId)
+		c.Locals(CTX_REQUESTID, requestId)
+		c.SetUserContext(ContextWithRequestId(c.UserContext(), requestId))
+		return c.Next()
+	}
+}
+
+// RequestIdFromDelivery returns the request id propagated in the amqp
+// headers of the delivery
+func RequestIdFromDelivery(delivery amqp.Delivery) (string, bool) {
+	requestId, ok := delivery.Headers[HTTP_HEADER_REQUEST_ID].(string)
+	return requestId, ok && requestId != ""
+}
+
+// RabbitHeadersWithRequestId returns the amqp headers carrying the
+// request id of ctx
+func RabbitHeadersWithRequestId(ctx context.Context, headers amqp.Table) amqp.Table {
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	if requestId, ok := RequestIdFromContext(ctx); ok {
+		headers[HTTP_HEADER_REQUEST_ID] = requestId
+	}
+	return headers
+}
+
+// PropagationTransport is an http.RoundTripper adding the request id
+// and the trace context of the request context to outgoing calls
+type PropagationTransport struct {
+	Base http.RoundTripper
+}
+
+// NewPropagationClient returns an http.Client using PropagationTransport.
+// Requests must be created with http.NewRequestWithContext passing the
+// context of the current request (e.g. fiber.Ctx.UserContext)
+func NewPropagationClient() *http.Client {
+	return &http.Client{Transport: &PropagationTransport{}}
+}
+
+func (t *PropagationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx := req.Context()
+	requestId, hasRequestId := RequestIdFromContext(ctx)
+	_, hasTrace := TraceContextFromContext(ctx)
+	if !hasRequestId && !hasTrace {
+		return base.RoundTrip(req)
+	}
+	// a RoundTripper must not modify the request
+	out := req.Clone(ctx)
+	if hasRequestId && out.Header.Get(HTTP_HEADER_REQUEST_ID) == "" {
+		out.Header.Set(HTTP_HEADER_REQUEST_ID, requestId)
+	}
+	InjectTraceHeaders(ctx, func(key string, value string) {
+		out.Header.Set(key, value)
+	})
+	return base.RoundTrip(out)
+}
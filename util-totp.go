@@ -0,0 +1,232 @@
+package api_common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const totpDefaultDigits = 6
+const totpDefaultPeriodSeconds = 30
+const totpDefaultSkew = 1
+const totpDefaultRecoveryCodes = 10
+const totpSecretSize = 20
+
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TotpEnrollment contains everything produced when enabling TOTP for
+// an account. Secret, Uri and RecoveryCodes are shown once to the user,
+// EncryptedSecret and HashedRecoveryCodes are the values to be stored
+type TotpEnrollment struct {
+	Secret              string   `json:"secret"`
+	Uri                 string   `json:"uri"`
+	RecoveryCodes       []string `json:"recovery_codes"`
+	EncryptedSecret     string   `json:"-"`
+	HashedRecoveryCodes []string `json:"-"`
+}
+
+// TotpAuthenticator implements RFC 6238 time-based one-time passwords
+// (HMAC-SHA1) compatible with the common authenticator apps
+type TotpAuthenticator struct {
+	issuer        string
+	digits        int
+	period        time.Duration
+	skew          int
+	recoveryCodes int
+	encryptionKey string
+}
+
+// NewTotpAuthenticator returns a TotpAuthenticator configured by the
+// Application.Totp section. Secrets are encrypted with the key in
+// Totp.EncryptionKeyFilepath or, if missing, Database.EncryptionKeyFilepath
+func NewTotpAuthenticator(serviceConfig MicroserviceConfiguration) (*TotpAuthenticator, error) {
+	config := serviceConfig.Application.Totp
+	authenticator := &TotpAuthenticator{
+		issuer:        config.Issuer,
+		digits:        config.Digits,
+		period:        time.Duration(config.PeriodSeconds) * time.Second,
+		skew:          config.Skew,
+		recoveryCodes: config.RecoveryCodes,
+	}
+	if authenticator.issuer == "" {
+		authenticator.issuer = serviceConfig.Application.Name
+	}
+	if authenticator.digits == 0 {
+		authenticator.digits = totpDefaultDigits
+	}
+	if authenticator.digits < 6 || authenticator.digits > 8 {
+		return nil, fmt.Errorf("cannot create totp authenticator: digits must be between 6 and 8")
+	}
+	if authenticator.period <= 0 {
+		authenticator.period = totpDefaultPeriodSeconds * time.Second
+	}
+	// zero disables the skew, only negative values use the default
+	if authenticator.skew < 0 {
+		authenticator.skew = totpDefaultSkew
+	}
+	if authenticator.recoveryCodes <= 0 {
+		authenticator.recoveryCodes = totpDefaultRecoveryCodes
+	}
+	keyFilepath := config.EncryptionKeyFilepath
+	if keyFilepath == "" {
+		keyFilepath = serviceConfig.Infrastructure.Database.EncryptionKeyFilepath
+	}
+	encryptionKey, errGetSecret := GetSecretString(keyFilepath)
+	if errGetSecret != nil {
+		return nil, errGetSecret
+	}
+	authenticator.encryptionKey = encryptionKey
+	return authenticator, nil
+}
+
+// TotpGenerateSecret returns a new random base32 encoded secret
+func TotpGenerateSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, errRandRead := rand.Read(secret); errRandRead != nil {
+		return "", fmt.Errorf("cannot create random totp secret: %s", errRandRead.Error())
+	}
+	return totpBase32.EncodeToString(secret), nil
+}
+
+// TotpGenerateCode returns the code of the given secret valid at time t
+func TotpGenerateCode(secret string, t time.Time, digits int, period time.Duration) (string, error) {
+	key, errDecode := totpBase32.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if errDecode != nil {
+		return "", fmt.Errorf("cannot decode totp secret: %s", errDecode.Error())
+	}
+	if period < time.Second {
+		return "", fmt.Errorf("cannot generate totp code: period must be at least 1s")
+	}
+	return totpCode(key, uint64(t.Unix()/int64(period.Seconds())), digits), nil
+}
+
+func totpCode(key []byte, step uint64, digits int) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
+
+// ProvisioningUri returns the otpauth:// uri to be encoded in the QR
+// code scanned by the authenticator app
+func (a *TotpAuthenticator) ProvisioningUri(secret string, accountName string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", a.issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", strconv.Itoa(a.digits))
+	values.Set("period", strconv.Itoa(int(a.period.Seconds())))
+	label := url.PathEscape(a.issuer) + ":" + url.PathEscape(accountName)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// Enroll generates a new secret and the recovery codes for the account
+func (a *TotpAuthenticator) Enroll(accountName string) (TotpEnrollment, error) {
+	secret, errSecret := TotpGenerateSecret()
+	if errSecret != nil {
+		return TotpEnrollment{}, errSecret
+	}
+	encryptedSecret, errEncrypt := CryptoEncryptText(secret, a.encryptionKey)
+	if errEncrypt != nil {
+		return TotpEnrollment{}, errEncrypt
+	}
+	recoveryCodes, hashedRecoveryCodes, errRecovery := a.GenerateRecoveryCodes()
+	if errRecovery != nil {
+		return TotpEnrollment{}, errRecovery
+	}
+	return TotpEnrollment{
+		Secret:              secret,
+		Uri:                 a.ProvisioningUri(secret, accountName),
+		RecoveryCodes:       recoveryCodes,
+		EncryptedSecret:     encryptedSecret,
+		HashedRecoveryCodes: hashedRecoveryCodes,
+	}, nil
+}
+
+// Verify checks the code against the encrypted secret, accepting the
+// codes of Totp.Skew periods before and after now. Codes of a period
+// lower or equal to lastUsedStep are rejected to prevent replays: on
+// success the returned step must be stored as the new lastUsedStep
+func (a *TotpAuthenticator) Verify(encryptedSecret string, code string, lastUsedStep int64, now time.Time) (int64, bool, error) {
+	secret, errDecrypt := CryptoDecryptText(encryptedSecret, a.encryptionKey)
+	if errDecrypt != nil {
+		return lastUsedStep, false, errDecrypt
+	}
+	key, errDecode := totpBase32.DecodeString(secret)
+	if errDecode != nil {
+		return lastUsedStep, false, fmt.Errorf("cannot decode totp secret: %s", errDecode.Error())
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != a.digits {
+		return lastUsedStep, false, nil
+	}
+	current := now.Unix() / int64(a.period.Seconds())
+	matched := int64(-1)
+	for step := current - int64(a.skew); step <= current+int64(a.skew); step++ {
+		if step < 0 {
+			continue
+		}
+		// every step is checked to keep the verification time constant
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(step), a.digits)), []byte(code)) == 1 && matched < 0 {
+			matched = step
+		}
+	}
+	if matched < 0 || matched <= lastUsedStep {
+		return lastUsedStep, false, nil
+	}
+	return matched, true, nil
+}
+
+// GenerateRecoveryCodes returns new one-time recovery codes and their
+// hashes to be stored
+func (a *TotpAuthenticator) GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, a.recoveryCodes)
+	hashes := make([]string, 0, a.recoveryCodes)
+	for i := 0; i < a.recoveryCodes; i++ {
+		raw := make([]byte, 5)
+		if _, errRandRead := rand.Read(raw); errRandRead != nil {
+			return nil, nil, fmt.Errorf("cannot create random recovery code: %s", errRandRead.Error())
+		}
+		encoded := strings.ToLower(totpBase32.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, TotpHashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// TotpHashRecoveryCode returns the hash stored for a recovery code
+func TotpHashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return CryptoSha256String(normalized)
+}
+
+// TotpVerifyRecoveryCode returns the index of the matching hash, or -1.
+// The matching hash must be removed from the stored ones, since every
+// recovery code can be used only once
+func TotpVerifyRecoveryCode(code string, hashedCodes []string) int {
+	hashed := []byte(TotpHashRecoveryCode(code))
+	index := -1
+	for i, hashedCode := range hashedCodes {
+		if subtle.ConstantTimeCompare(hashed, []byte(hashedCode)) == 1 && index < 0 {
+			index = i
+		}
+	}
+	return index
+}
@@ -0,0 +1,469 @@
+package api_common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+)
+
+// SPAN_KIND_* follow the OpenTelemetry span kinds
+const (
+	SPAN_KIND_INTERNAL = "internal"
+	SPAN_KIND_SERVER   = "server"
+	SPAN_KIND_CLIENT   = "client"
+	SPAN_KIND_PRODUCER = "producer"
+	SPAN_KIND_CONSUMER = "consumer"
+)
+
+// SPAN_STATUS_* follow the OpenTelemetry span status codes
+const (
+	SPAN_STATUS_UNSET = "unset"
+	SPAN_STATUS_OK    = "ok"
+	SPAN_STATUS_ERROR = "error"
+)
+
+const traceFlagSampled = 0x01
+
+type traceContextKey struct{}
+
+// TraceContext is the W3C trace context propagated between services
+type TraceContext struct {
+	TraceId    [16]byte
+	SpanId     [8]byte
+	Flags      byte
+	TraceState string
+}
+
+// IsValid returns true if trace and span ids are not zero
+func (t TraceContext) IsValid() bool {
+	return t.TraceId != [16]byte{} && t.SpanId != [8]byte{}
+}
+
+// IsSampled returns true if the sampled flag is set
+func (t TraceContext) IsSampled() bool {
+	return t.Flags&traceFlagSampled != 0
+}
+
+// TraceIdString returns the hex trace id
+func (t TraceContext) TraceIdString() string {
+	return hex.EncodeToString(t.TraceId[:])
+}
+
+// SpanIdString returns the hex span id
+func (t TraceContext) SpanIdString() string {
+	return hex.EncodeToString(t.SpanId[:])
+}
+
+// Traceparent returns the traceparent header value
+func (t TraceContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", t.TraceIdString(), t.SpanIdString(), t.Flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(traceparent string) (TraceContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return TraceContext{}, fmt.Errorf("cannot parse traceparent: invalid format")
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return TraceContext{}, fmt.Errorf("cannot parse traceparent: invalid version %s", parts[0])
+	}
+	var tc TraceContext
+	if _, err := hex.Decode(tc.TraceId[:], []byte(parts[1])); err != nil {
+		return TraceContext{}, fmt.Errorf("cannot parse traceparent trace id: %s", err.Error())
+	}
+	if _, err := hex.Decode(tc.SpanId[:], []byte(parts[2])); err != nil {
+		return TraceContext{}, fmt.Errorf("cannot parse traceparent span id: %s", err.Error())
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return TraceContext{}, fmt.Errorf("cannot parse traceparent flags: %s", err.Error())
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return TraceContext{}, fmt.Errorf("cannot parse traceparent: zero trace or span id")
+	}
+	return tc, nil
+}
+
+// SpanData is the immutable representation of an ended span, passed
+// to the SpanExporter
+type SpanData struct {
+	Name          string
+	Kind          string
+	Service       string
+	TraceId       string
+	SpanId        string
+	ParentSpanId  string
+	Start         time.Time
+	End           time.Time
+	Attributes    map[string]interface{}
+	Status        string
+	StatusMessage string
+}
+
+// Duration returns the duration of the span
+func (s SpanData) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// SpanExporter receives the ended and sampled spans
+type SpanExporter interface {
+	ExportSpan(span SpanData)
+}
+
+// InMemorySpanExporter keeps the exported spans in memory, for tests
+type InMemorySpanExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// NewInMemorySpanExporter returns an empty InMemorySpanExporter
+func NewInMemorySpanExporter() *InMemorySpanExporter {
+	return &InMemorySpanExporter{}
+}
+
+func (e *InMemorySpanExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns a copy of the exported spans
+func (e *InMemorySpanExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData{}, e.spans...)
+}
+
+// Reset removes every exported span
+func (e *InMemorySpanExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// LogSpanExporter writes the spans as debug logs
+type LogSpanExporter struct{}
+
+func (LogSpanExporter) ExportSpan(span SpanData) {
+	log.WithFields(log.Fields{
+		"trace_id":       span.TraceId,
+		"span_id":        span.SpanId,
+		"parent_span_id": span.ParentSpanId,
+		"span_kind":      span.Kind,
+		"duration_ms":    span.Duration().Milliseconds(),
+		"status":         span.Status,
+		"attributes":     span.Attributes,
+	}).Debugf("span %s ended", span.Name)
+}
+
+// Span is an operation being traced
+type Span struct {
+	mu            sync.Mutex
+	tracer        *Tracer
+	name          string
+	kind          string
+	context       TraceContext
+	parentSpanId  [8]byte
+	start         time.Time
+	attributes    map[string]interface{}
+	status        string
+	statusMessage string
+	ended         bool
+}
+
+// Context returns the trace context of the span
+func (s *Span) Context() TraceContext {
+	return s.context
+}
+
+// SetAttribute sets an attribute of the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetName changes the name of the span, e.g. once the route is known
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetStatus sets the status of the span, one of SPAN_STATUS_*
+func (s *Span) SetStatus(status string, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	s.statusMessage = message
+}
+
+// RecordError marks the span as failed with the given error
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.SetStatus(SPAN_STATUS_ERROR, err.Error())
+}
+
+// End ends the span and exports it if sampled. Further calls are ignored
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		Name:          s.name,
+		Kind:          s.kind,
+		Service:       s.tracer.service,
+		TraceId:       s.context.TraceIdString(),
+		SpanId:        s.context.SpanIdString(),
+		Start:         s.start,
+		End:           time.Now(),
+		Attributes:    s.attributes,
+		Status:        s.status,
+		StatusMessage: s.statusMessage,
+	}
+	if s.parentSpanId != [8]byte{} {
+		data.ParentSpanId = hex.EncodeToString(s.parentSpanId[:])
+	}
+	s.mu.Unlock()
+	if s.context.IsSampled() && s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+// Tracer creates spans and sends them to its exporter
+type Tracer struct {
+	service  string
+	exporter SpanExporter
+}
+
+// NewTracer returns a Tracer for the given service. A nil exporter
+// disables the export while still propagating the trace context
+func NewTracer(service string, exporter SpanExporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+var globalTracerMu sync.RWMutex
+var globalTracer = NewTracer("", nil)
+
+// SetTracer sets the tracer used by the library helpers
+func SetTracer(tracer *Tracer) {
+	globalTracerMu.Lock()
+	defer globalTracerMu.Unlock()
+	globalTracer = tracer
+}
+
+// GetTracer returns the tracer used by the library helpers
+func GetTracer() *Tracer {
+	globalTracerMu.RLock()
+	defer globalTracerMu.RUnlock()
+	return globalTracer
+}
+
+// ContextWithTraceContext returns a context carrying a remote trace
+// context, used as parent by the next StartSpan
+func ContextWithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context of the current span
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	if ctx == nil {
+		return TraceContext{}, false
+	}
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok && tc.IsValid()
+}
+
+// StartSpan starts a span child of the span in ctx, or a new trace
+// if ctx has none, and returns a context carrying the new span
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind string) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+		status:     SPAN_STATUS_UNSET,
+	}
+	if parent, ok := TraceContextFromContext(ctx); ok {
+		span.context.TraceId = parent.TraceId
+		span.context.Flags = parent.Flags
+		span.context.TraceState = parent.TraceState
+		span.parentSpanId = parent.SpanId
+	} else {
+		_, _ = rand.Read(span.context.TraceId[:])
+		span.context.Flags = traceFlagSampled
+	}
+	_, _ = rand.Read(span.context.SpanId[:])
+	return ContextWithTraceContext(ctx, span.context), span
+}
+
+// InjectTraceHeaders sets traceparent and tracestate from ctx using set
+func InjectTraceHeaders(ctx context.Context, set func(key string, value string)) {
+	tc, ok := TraceContextFromContext(ctx)
+	if !ok {
+		return
+	}
+	set(HTTP_HEADER_TRACEPARENT, tc.Traceparent())
+	if tc.TraceState != "" {
+		set(HTTP_HEADER_TRACESTATE, tc.TraceState)
+	}
+}
+
+// ExtractTraceHeaders returns ctx with the remote trace context read
+// through get, or ctx itself if there is no valid traceparent
+func ExtractTraceHeaders(ctx context.Context, get func(key string) string) context.Context {
+	tc, err := ParseTraceparent(get(HTTP_HEADER_TRACEPARENT))
+	if err != nil {
+		return ctx
+	}
+	tc.TraceState = get(HTTP_HEADER_TRACESTATE)
+	return ContextWithTraceContext(ctx, tc)
+}
+
+// TracingMiddleware traces every request with a server span, continuing
+// the trace of the inbound traceparent header. The span context is set
+// as user context of the request and returned in the traceparent
+// response header
+func TracingMiddleware(tracer *Tracer) func(ctx *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		parent := ExtractTraceHeaders(c.UserContext(), func(key string) string {
+			return c.Get(key)
+		})
+		ctx, span := tracer.StartSpan(parent, c.Method()+" "+c.Path(), SPAN_KIND_SERVER)
+		defer span.End()
+		c.SetUserContext(ctx)
+		span.SetAttribute("http.method", c.Method())
+		span.SetAttribute("http.target", c.OriginalURL())
+		span.SetAttribute("http.client_ip", c.IP())
+		if reqId, ok := c.Locals(CTX_REQUESTID).(string); ok {
+			span.SetAttribute("http.request_id", reqId)
+		}
+		InjectTraceHeaders(ctx, func(key string, value string) {
+			c.Set(key, value)
+		})
+
+		errNext := c.Next()
+		status := c.Response().StatusCode()
+		if errNext != nil {
+			if fiberErr, ok := errNext.(*fiber.Error); ok {
+				status = fiberErr.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+			span.RecordError(errNext)
+		} else if status >= 500 {
+			span.SetStatus(SPAN_STATUS_ERROR, fmt.Sprintf("http status %d", status))
+		}
+		span.SetAttribute("http.status_code", status)
+		if route := c.Route(); route != nil && route.Path != "" {
+			span.SetName(c.Method() + " " + route.Path)
+			span.SetAttribute("http.route", route.Path)
+		}
+		return errNext
+	}
+}
+
+// RabbitHeadersWithTrace returns the amqp headers carrying the trace
+// context of ctx
+func RabbitHeadersWithTrace(ctx context.Context, headers amqp.Table) amqp.Table {
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	InjectTraceHeaders(ctx, func(key string, value string) {
+		headers[key] = value
+	})
+	return headers
+}
+
+// StartRabbitConsumerSpan starts a consumer span for a delivery read
+// from GetRabbitConsumer, continuing the trace of the publisher, and
+// counts the delivery. The returned context carries also the propagated
+// request id
+func StartRabbitConsumerSpan(ctx context.Context, delivery amqp.Delivery, queue string) (context.Context, *Span) {
+	metricRabbitDelivered.Inc(queue)
+	parent := ExtractTraceHeaders(ctx, func(key string) string {
+		value, _ := delivery.Headers[key].(string)
+		return value
+	})
+	if requestId, ok := RequestIdFromDelivery(delivery); ok {
+		parent = ContextWithRequestId(parent, requestId)
+	}
+	spanCtx, span := GetTracer().StartSpan(parent, queue+" process", SPAN_KIND_CONSUMER)
+	span.SetAttribute("messaging.system", "rabbitmq")
+	span.SetAttribute("messaging.source", queue)
+	span.SetAttribute("messaging.rabbitmq.routing_key", delivery.RoutingKey)
+	span.SetAttribute("messaging.message_id", delivery.MessageId)
+	return spanCtx, span
+}
+
+const gormSpanKey = "api_common:span"
+
+// RegisterGormTracing adds callbacks to db creating a client span for
+// every query, child of the span in the statement context (see
+// gorm.DB.WithContext)
+func RegisterGormTracing(db *gorm.DB, tracer *Tracer) error {
+	before := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			ctx, span := tracer.StartSpan(tx.Statement.Context, "db."+operation, SPAN_KIND_CLIENT)
+			span.SetAttribute("db.system", tx.Dialector.Name())
+			span.SetAttribute("db.operation", operation)
+			tx.Statement.Context = ctx
+			tx.InstanceSet(gormSpanKey, span)
+		}
+	}
+	after := func(tx *gorm.DB) {
+		value, ok := tx.InstanceGet(gormSpanKey)
+		if !ok {
+			return
+		}
+		span := value.(*Span)
+		span.SetAttribute("db.statement", tx.Statement.SQL.String())
+		span.SetAttribute("db.sql.table", tx.Statement.Table)
+		span.SetAttribute("db.rows_affected", tx.Statement.RowsAffected)
+		if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
+			span.RecordError(tx.Error)
+		}
+		span.End()
+	}
+	registrations := []struct {
+		operation string
+		before    func(name string, fn func(*gorm.DB)) error
+		after     func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", db.Callback().Create().Before("gorm:create").Register, db.Callback().Create().After("gorm:create").Register},
+		{"query", db.Callback().Query().Before("gorm:query").Register, db.Callback().Query().After("gorm:query").Register},
+		{"update", db.Callback().Update().Before("gorm:update").Register, db.Callback().Update().After("gorm:update").Register},
+		{"delete", db.Callback().Delete().Before("gorm:delete").Register, db.Callback().Delete().After("gorm:delete").Register},
+		{"row", db.Callback().Row().Before("gorm:row").Register, db.Callback().Row().After("gorm:row").Register},
+		{"raw", db.Callback().Raw().Before("gorm:raw").Register, db.Callback().Raw().After("gorm:raw").Register},
+	}
+	for _, registration := range registrations {
+		if err := registration.before("api_common:trace_before_"+registration.operation, before(registration.operation)); err != nil {
+			return fmt.Errorf("cannot register gorm tracing callback: %s", err.Error())
+		}
+		if err := registration.after("api_common:trace_after_"+registration.operation, after); err != nil {
+			return fmt.Errorf("cannot register gorm tracing callback: %s", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,529 @@
+package api_common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const rabbitDefaultMinBackoff = 500 * time.Millisecond
+const rabbitDefaultMaxBackoff = 30 * time.Second
+
+// ErrRabbitNotConnected is returned while the manager is reconnecting
+var ErrRabbitNotConnected = errors.New("rabbit connection not available")
+
+// ErrRabbitManagerClosed is returned after Close has been called
+var ErrRabbitManagerClosed = errors.New("rabbit connection manager closed")
+
+var (
+	metricRabbitConnected = DefaultMetricsRegistry.NewGaugeVec("rabbit_connected",
+		"1 if the rabbit connection is open, 0 otherwise")
+	metricRabbitReconnects = DefaultMetricsRegistry.NewCounterVec("rabbit_reconnects_total",
+		"Number of reconnections to the rabbit broker")
+)
+
+// RabbitConsumeOptions configures a consumer registered with
+// RabbitConnectionManager.Consume
+type RabbitConsumeOptions struct {
+	Queue       string
+	ConsumerTag string
+	AutoAck     bool
+	Exclusive   bool
+	// Prefetch sets the channel QoS, limiting the unacknowledged
+	// deliveries; 0 means unlimited
+	Prefetch int
+	Args     amqp.Table
+}
+
+type rabbitManagedConsumer struct {
+	options RabbitConsumeOptions
+	out     chan amqp.Delivery
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// RabbitConnectionManager owns the amqp connection: it reconnects with
+// exponential backoff when the broker closes it, re-declares the
+// registered topology, re-establishes the consumers and serializes the
+// use of the shared publishing channel, since amqp.Channel is not safe
+// for concurrent publishing
+type RabbitConnectionManager struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	url       string
+	startMu   sync.Mutex
+	started   bool
+	mu        sync.RWMutex
+	conn      *amqp.Connection
+	connected chan struct{}
+	closed    bool
+	done      chan struct{}
+
+	publishMu sync.Mutex
+	publishCh *amqp.Channel
+
+	topologyMu sync.Mutex
+	topology   []func(ch *amqp.Channel) error
+	routes     RabbitTopology
+	consumers  []*rabbitManagedConsumer
+	reconnects []func()
+}
+
+// NewRabbitConnectionManager returns a manager for the broker at url.
+// Start must be called to connect
+func NewRabbitConnectionManager(url string) *RabbitConnectionManager {
+	return &RabbitConnectionManager{
+		MinBackoff: rabbitDefaultMinBackoff,
+		MaxBackoff: rabbitDefaultMaxBackoff,
+		url:        url,
+		connected:  make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// NewRabbitConnectionManagerFromConfig returns a manager for Rabbit.Url.
+// If Rabbit.Topology.DeclareOnStartup is set, the topology returned by
+// GetRabbitTopology is declared on connection and after every
+// reconnection, before the consumers are re-established, while the
+// routes of GetRabbitRoutesTopology are only checked, logging a warning
+// for the missing ones
+func NewRabbitConnectionManagerFromConfig(rabbit Rabbit) (*RabbitConnectionManager, error) {
+	manager := NewRabbitConnectionManager(rabbit.Url)
+	if !rabbit.Topology.DeclareOnStartup {
+		return manager, nil
+	}
+	manager.routes = GetRabbitRoutesTopology(rabbit)
+	topology := GetRabbitTopology(rabbit)
+	// validated here, since an invalid topology would fail every connection
+	if err := topology.Validate(); err != nil {
+		return nil, fmt.Errorf("cannot declare rabbit topology: %s", err.Error())
+	}
+	err := manager.DeclareTopology(func(ch *amqp.Channel) error {
+		return DeclareRabbitTopology(ch, topology)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// Start connects to the broker, retrying with backoff until ctx is done,
+// then keeps the connection alive in background. Once it has succeeded
+// further calls do nothing, while after a failure it can be called again
+func (m *RabbitConnectionManager) Start(ctx context.Context) error {
+	m.startMu.Lock()
+	defer m.startMu.Unlock()
+	if m.started {
+		return nil
+	}
+	if err := m.connectWithBackoff(ctx); err != nil {
+		return err
+	}
+	m.started = true
+	return nil
+}
+
+func (m *RabbitConnectionManager) backoff(attempt int) time.Duration {
+	delay := m.MinBackoff << uint(attempt)
+	if delay <= 0 || delay > m.MaxBackoff {
+		delay = m.MaxBackoff
+	}
+	// full jitter on the upper half, so instances do not reconnect together
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (m *RabbitConnectionManager) connectWithBackoff(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		err := m.connect()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrRabbitManagerClosed) {
+			return err
+		}
+		delay := m.backoff(attempt)
+		log.WithError(err).Warnf("cannot connect to rabbit, retrying in %s", delay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cannot connect to rabbit: %s", ctx.Err().Error())
+		case <-m.done:
+			return ErrRabbitManagerClosed
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (m *RabbitConnectionManager) connect() error {
+	conn, err := amqp.Dial(m.url)
+	if err != nil {
+		return err
+	}
+	m.topologyMu.Lock()
+	topology := append([]func(ch *amqp.Channel) error{}, m.topology...)
+	routes := m.routes
+	consumers := append([]*rabbitManagedConsumer{}, m.consumers...)
+	reconnects := append([]func(){}, m.reconnects...)
+	m.topologyMu.Unlock()
+
+	if err = m.declare(conn, topology); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	m.checkRoutes(conn, routes)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		_ = conn.Close()
+		return ErrRabbitManagerClosed
+	}
+	wasConnectedBefore := m.conn != nil
+	m.conn = conn
+	close(m.connected)
+	m.mu.Unlock()
+
+	m.publishMu.Lock()
+	m.publishCh = nil
+	m.publishMu.Unlock()
+
+	for _, consumer := range consumers {
+		if errConsume := m.startConsumer(conn, consumer); errConsume != nil {
+			log.WithError(errConsume).Errorf("cannot re-establish consumer on queue %s", consumer.options.Queue)
+		}
+	}
+
+	metricRabbitConnected.Set(1)
+	if wasConnectedBefore {
+		metricRabbitReconnects.Inc()
+		log.Infoln("reconnected to rabbit")
+		for _, fn := range reconnects {
+			fn()
+		}
+	} else {
+		log.Infoln("connected to rabbit")
+	}
+
+	notify := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go m.watch(conn, notify)
+	return nil
+}
+
+func (m *RabbitConnectionManager) declare(conn *amqp.Connection, topology []func(ch *amqp.Channel) error) error {
+	if len(topology) == 0 {
+		return nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	for _, declare := range topology {
+		if err = declare(ch); err != nil {
+			return fmt.Errorf("cannot declare rabbit topology: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// checkRoutes warns about the routes missing on the broker, which are
+// not declared since their settings are unknown
+func (m *RabbitConnectionManager) checkRoutes(conn *amqp.Connection, routes RabbitTopology) {
+	if len(routes.Exchanges) == 0 && len(routes.Queues) == 0 {
+		return
+	}
+	changes, err := DiffRabbitTopology(conn.Channel, routes)
+	if err != nil {
+		log.WithError(err).Warnln("cannot check rabbit routes")
+		return
+	}
+	for _, change := range changes {
+		if change.Action == RABBIT_TOPOLOGY_CREATE {
+			log.Warnf("rabbit %s %s does not exist and is not declared, add it to the topology", change.Kind, change.Name)
+		}
+	}
+}
+
+func (m *RabbitConnectionManager) watch(conn *amqp.Connection, notify chan *amqp.Error) {
+	amqpErr, ok := <-notify
+	m.mu.Lock()
+	if m.conn == conn {
+		m.connected = make(chan struct{})
+	}
+	closed := m.closed
+	m.mu.Unlock()
+	metricRabbitConnected.Set(0)
+	if closed {
+		return
+	}
+	if ok && amqpErr != nil {
+		log.WithField("error", amqpErr.Error()).Errorln("rabbit connection lost, reconnecting")
+	} else {
+		log.Warnln("rabbit connection closed, reconnecting")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-m.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	defer cancel()
+	if err := m.connectWithBackoff(ctx); err != nil && !errors.Is(err, ErrRabbitManagerClosed) {
+		log.WithError(err).Errorln("rabbit reconnection stopped")
+	}
+}
+
+// IsConnected returns true if the connection is currently open
+func (m *RabbitConnectionManager) IsConnected() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.conn != nil && !m.conn.IsClosed() && !m.closed
+}
+
+// WaitConnected blocks until the connection is open or ctx is done
+func (m *RabbitConnectionManager) WaitConnected(ctx context.Context) error {
+	for {
+		m.mu.RLock()
+		connected := m.connected
+		closed := m.closed
+		m.mu.RUnlock()
+		if closed {
+			return ErrRabbitManagerClosed
+		}
+		select {
+		case <-connected:
+			if m.IsConnected() {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Connection returns the current connection
+func (m *RabbitConnectionManager) Connection() (*amqp.Connection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrRabbitManagerClosed
+	}
+	if m.conn == nil || m.conn.IsClosed() {
+		return nil, ErrRabbitNotConnected
+	}
+	return m.conn, nil
+}
+
+// Channel opens a new channel owned by the caller, who must close it
+func (m *RabbitConnectionManager) Channel() (*amqp.Channel, error) {
+	conn, err := m.Connection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Channel()
+}
+
+// WithChannel runs fn with the shared publishing channel, holding a lock
+// so that concurrent goroutines never use it at the same time. The
+// channel is reopened if a previous error closed it
+func (m *RabbitConnectionManager) WithChannel(fn func(ch *amqp.Channel) error) error {
+	m.publishMu.Lock()
+	defer m.publishMu.Unlock()
+	if m.publishCh == nil {
+		ch, err := m.Channel()
+		if err != nil {
+			return err
+		}
+		m.publishCh = ch
+		notify := ch.NotifyClose(make(chan *amqp.Error, 1))
+		go func() {
+			<-notify
+			m.publishMu.Lock()
+			if m.publishCh == ch {
+				m.publishCh = nil
+			}
+			m.publishMu.Unlock()
+		}()
+	}
+	err := fn(m.publishCh)
+	if err == amqp.ErrClosed {
+		m.publishCh = nil
+	}
+	return err
+}
+
+// Publish publishes the message on the shared channel, propagating the
+// trace context and the request id of ctx
+func (m *RabbitConnectionManager) Publish(ctx context.Context, exchange string, key string, body []byte) error {
+	return m.WithChannel(func(ch *amqp.Channel) error {
+		return PublishMessageWithContext(ctx, ch, exchange, key, body)
+	})
+}
+
+// DeclareTopology registers a declaration run on every (re)connection,
+// and runs it immediately if connected
+func (m *RabbitConnectionManager) DeclareTopology(declare func(ch *amqp.Channel) error) error {
+	m.topologyMu.Lock()
+	m.topology = append(m.topology, declare)
+	m.topologyMu.Unlock()
+	conn, err := m.Connection()
+	if err != nil {
+		return nil
+	}
+	return m.declare(conn, []func(ch *amqp.Channel) error{declare})
+}
+
+// NotifyReconnect registers fn, called after every reconnection
+func (m *RabbitConnectionManager) NotifyReconnect(fn func()) {
+	m.topologyMu.Lock()
+	defer m.topologyMu.Unlock()
+	m.reconnects = append(m.reconnects, fn)
+}
+
+// Consume registers a consumer re-established after every reconnection.
+// The returned channel keeps delivering across reconnections and is
+// closed when ctx is done or the manager is closed. Deliveries received
+// before a reconnection cannot be acknowledged after it
+func (m *RabbitConnectionManager) Consume(ctx context.Context, options RabbitConsumeOptions) (<-chan amqp.Delivery, error) {
+	consumerCtx, cancel := context.WithCancel(ctx)
+	consumer := &rabbitManagedConsumer{
+		options: options,
+		out:     make(chan amqp.Delivery),
+		ctx:     consumerCtx,
+		cancel:  cancel,
+	}
+	if conn, err := m.Connection(); err == nil {
+		if errStart := m.startConsumer(conn, consumer); errStart != nil {
+			cancel()
+			return nil, errStart
+		}
+	}
+	m.topologyMu.Lock()
+	m.consumers = append(m.consumers, consumer)
+	m.topologyMu.Unlock()
+	go func() {
+		select {
+		case <-consumerCtx.Done():
+		case <-m.done:
+			cancel()
+		}
+		consumer.wg.Wait()
+		m.topologyMu.Lock()
+		for i, registered := range m.consumers {
+			if registered == consumer {
+				m.consumers = append(m.consumers[:i], m.consumers[i+1:]...)
+				break
+			}
+		}
+		m.topologyMu.Unlock()
+		close(consumer.out)
+	}()
+	return consumer.out, nil
+}
+
+func (m *RabbitConnectionManager) startConsumer(conn *amqp.Connection, consumer *rabbitManagedConsumer) error {
+	if consumer.ctx.Err() != nil {
+		return nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if consumer.options.Prefetch > 0 {
+		if err = ch.Qos(consumer.options.Prefetch, 0, false); err != nil {
+			_ = ch.Close()
+			return err
+		}
+	}
+	deliveries, err := ch.Consume(
+		consumer.options.Queue,
+		consumer.options.ConsumerTag,
+		consumer.options.AutoAck,
+		consumer.options.Exclusive,
+		false,
+		false,
+		consumer.options.Args,
+	)
+	if err != nil {
+		_ = ch.Close()
+		return err
+	}
+	consumer.wg.Add(1)
+	go func() {
+		defer consumer.wg.Done()
+		defer ch.Close()
+		for {
+			select {
+			case <-consumer.ctx.Done():
+				return
+			case delivery, ok := <-deliveries:
+				if !ok {
+					return
+				}
+				select {
+				case consumer.out <- delivery:
+				case <-consumer.ctx.Done():
+					// not handled: let the broker redeliver it
+					if !consumer.options.AutoAck {
+						_ = delivery.Nack(false, true)
+					}
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// HealthCheck returns a check failing while the connection is down,
+// to be registered in a HealthRegistry
+func (m *RabbitConnectionManager) HealthCheck() func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if !m.IsConnected() {
+			return ErrRabbitNotConnected
+		}
+		return nil
+	}
+}
+
+// Close stops the reconnections, cancels the consumers and closes the
+// connection
+func (m *RabbitConnectionManager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	conn := m.conn
+	m.mu.Unlock()
+
+	m.topologyMu.Lock()
+	consumers := append([]*rabbitManagedConsumer{}, m.consumers...)
+	m.topologyMu.Unlock()
+	for _, consumer := range consumers {
+		consumer.cancel()
+		consumer.wg.Wait()
+	}
+	m.publishMu.Lock()
+	if m.publishCh != nil {
+		_ = m.publishCh.Close()
+		m.publishCh = nil
+	}
+	m.publishMu.Unlock()
+	metricRabbitConnected.Set(0)
+	if conn != nil && !conn.IsClosed() {
+		return conn.Close()
+	}
+	return nil
+}
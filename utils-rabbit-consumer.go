@@ -0,0 +1,361 @@
+package api_common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// RABBIT_HEADER_ATTEMPTS counts the failed deliveries of a message
+const RABBIT_HEADER_ATTEMPTS = "x-attempts"
+
+// RABBIT_HEADER_FAILURE_REASON contains the last error of a dead-lettered message
+const RABBIT_HEADER_FAILURE_REASON = "x-failure-reason"
+
+// RABBIT_HEADER_ORIGINAL_QUEUE contains the queue a dead-lettered message was consumed from
+const RABBIT_HEADER_ORIGINAL_QUEUE = "x-original-queue"
+
+const rabbitDefaultMaxAttempts = 5
+
+var rabbitDefaultRetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// RabbitHandler handles a delivery: a nil error acknowledges it, an error
+// schedules a retry or, after the last attempt, dead-letters it
+type RabbitHandler func(ctx context.Context, delivery amqp.Delivery) error
+
+type rabbitPermanentError struct {
+	err error
+}
+
+func (e rabbitPermanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e rabbitPermanentError) Unwrap() error {
+	return e.err
+}
+
+// RabbitPermanentError marks err as not retriable: the message is
+// dead-lettered immediately, e.g. when the body cannot be decoded
+func RabbitPermanentError(err error) error {
+	return rabbitPermanentError{err: err}
+}
+
+type rabbitDelayedError struct {
+	err error
+}
+
+func (e rabbitDelayedError) Error() string {
+	return e.err.Error()
+}
+
+func (e rabbitDelayedError) Unwrap() error {
+	return e.err
+}
+
+// RabbitDelayedError marks err as a temporary condition not caused by
+// the message, e.g. another delivery of it still in progress: the
+// message is retried after the first retry delay without counting an
+// attempt
+func RabbitDelayedError(err error) error {
+	return rabbitDelayedError{err: err}
+}
+
+// ConsumerConfig configures a Consumer
+type ConsumerConfig struct {
+	Queue       string
+	ConsumerTag string
+	// Concurrency is the number of deliveries handled in parallel, and the
+	// prefetch count of the channel unless Prefetch is set. Default 1
+	Concurrency int
+	Prefetch    int
+	// MaxAttempts is the number of attempts before dead-lettering. Default 5
+	MaxAttempts int
+	// RetryDelays are the delays of the retry queues, <queue>.retry.<delay>;
+	// the last one is used for the attempts exceeding them
+	RetryDelays []time.Duration
+	// DeadLetterExchange receives the messages failed after MaxAttempts,
+	// routed with DeadLetterKey (default Queue). If empty they are sent to
+	// the <queue>.dead queue
+	DeadLetterExchange string
+	DeadLetterKey      string
+	// HandlerTimeout bounds the context passed to the handler, if set
+	HandlerTimeout time.Duration
+}
+
+// Consumer runs a handler over a queue with manual acknowledgements,
+// bounded concurrency, delayed retries and dead-lettering. Panics of the
+// handler are recovered and handled as errors. Retried and dead-lettered
+// messages are acknowledged only once the broker confirms their
+// republishing
+type Consumer struct {
+	config    ConsumerConfig
+	handler   RabbitHandler
+	open      func() (*amqp.Channel, error)
+	publisher *ReliablePublisher
+}
+
+// NewConsumer returns a consumer opening its channel with open, which is
+// called again when the channel is closed
+func NewConsumer(open func() (*amqp.Channel, error), config ConsumerConfig, handler RabbitHandler) *Consumer {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.Prefetch <= 0 {
+		config.Prefetch = config.Concurrency
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = rabbitDefaultMaxAttempts
+	}
+	if len(config.RetryDelays) == 0 {
+		config.RetryDelays = rabbitDefaultRetryDelays
+	}
+	if config.DeadLetterKey == "" {
+		config.DeadLetterKey = config.Queue
+	}
+	return &Consumer{config: config, handler: handler, open: open, publisher: NewReliablePublisher(open)}
+}
+
+// NewConsumer returns a consumer on a channel of the managed connection
+func (m *RabbitConnectionManager) NewConsumer(config ConsumerConfig, handler RabbitHandler) *Consumer {
+	return NewConsumer(m.Channel, config, handler)
+}
+
+func (c *Consumer) retryQueue(delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", c.config.Queue, delay.Milliseconds())
+}
+
+func (c *Consumer) deadQueue() string {
+	return c.config.Queue + ".dead"
+}
+
+// Setup declares the retry queues, which dead-letter the expired messages
+// back to the consumed queue, and the dead queue when no dead letter
+// exchange is configured. The consumed queue must already exist
+func (c *Consumer) Setup(ch *amqp.Channel) error {
+	for _, delay := range c.config.RetryDelays {
+		_, err := ch.QueueDeclare(c.retryQueue(delay), true, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": c.config.Queue,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if c.config.DeadLetterExchange == "" {
+		if _, err := ch.QueueDeclare(c.deadQueue(), true, false, false, false, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start runs the consumer as a worker of lifecycle, stopped at shutdown
+func (c *Consumer) Start(lifecycle *Lifecycle) {
+	lifecycle.Go("consumer "+c.config.Queue, func(ctx context.Context) {
+		if err := c.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.WithError(err).Errorf("consumer %s stopped", c.config.Queue)
+		}
+	})
+}
+
+// Run consumes until ctx is cancelled, reopening the channel with backoff
+// when it is closed. Cancelling ctx only stops the intake: it returns
+// after the deliveries in progress are handled, while the prefetched ones
+// are requeued by the broker
+func (c *Consumer) Run(ctx context.Context) error {
+	defer c.publisher.Close()
+	for attempt := 0; ; attempt++ {
+		started, err := c.consume(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if started {
+			// the backoff grows only while the consumer cannot start
+			attempt = 0
+		}
+		delay := rabbitDefaultMinBackoff << uint(attempt)
+		if delay <= 0 || delay > rabbitDefaultMaxBackoff {
+			delay = rabbitDefaultMaxBackoff
+		}
+		log.WithError(err).Warnf("consumer %s interrupted, restarting in %s", c.config.Queue, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// consume handles the deliveries until the channel is closed or ctx is
+// cancelled. The returned bool is true if the consumer started
+func (c *Consumer) consume(ctx context.Context) (bool, error) {
+	ch, err := c.open()
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+	if err = c.Setup(ch); err != nil {
+		return false, err
+	}
+	if err = ch.Qos(c.config.Prefetch, 0, false); err != nil {
+		return false, err
+	}
+	tag := c.config.ConsumerTag
+	if tag == "" {
+		tag = c.config.Queue + "-" + RequestIdGeneratorUlid()
+	}
+	deliveries, err := ch.Consume(c.config.Queue, tag, false, false, false, false, nil)
+	if err != nil {
+		return false, err
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// stops the deliveries: the workers exit when the channel drains
+			_ = ch.Cancel(tag, false)
+		case <-stopped:
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < c.config.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for delivery := range deliveries {
+				if ctx.Err() != nil {
+					_ = delivery.Nack(false, true)
+					continue
+				}
+				c.handle(delivery)
+			}
+		}()
+	}
+	workers.Wait()
+	if ctx.Err() == nil {
+		return true, errors.New("deliveries channel closed")
+	}
+	return true, nil
+}
+
+func (c *Consumer) handle(delivery amqp.Delivery) {
+	// not derived from the Run context: the shutdown must not abort the
+	// handlers in progress, which are bounded only by HandlerTimeout
+	spanCtx, span := StartRabbitConsumerSpan(context.Background(), delivery, c.config.Queue)
+	defer span.End()
+	if c.config.HandlerTimeout > 0 {
+		var cancel context.CancelFunc
+		spanCtx, cancel = context.WithTimeout(spanCtx, c.config.HandlerTimeout)
+		defer cancel()
+	}
+
+	err := c.run(spanCtx, delivery)
+	RecordRabbitConsumed(c.config.Queue, err)
+	if err == nil {
+		if errAck := delivery.Ack(false); errAck != nil {
+			log.WithError(errAck).Errorf("cannot ack message %s", delivery.MessageId)
+		}
+		return
+	}
+	span.RecordError(err)
+
+	attempts := rabbitDeliveryAttempts(delivery) + 1
+	var permanent rabbitPermanentError
+	var delayed rabbitDelayedError
+	entry := log.WithError(err).WithField("attempts", attempts).WithField("queue", c.config.Queue)
+	switch {
+	case errors.As(err, &delayed):
+		entry.Infof("delaying message %s", delivery.MessageId)
+		err = c.retry(delivery, attempts-1, c.config.RetryDelays[0])
+	case errors.As(err, &permanent) || attempts >= c.config.MaxAttempts:
+		entry.Errorf("dead-lettering message %s", delivery.MessageId)
+		err = c.deadLetter(delivery, attempts, err)
+	default:
+		entry.Warnf("retrying message %s", delivery.MessageId)
+		index := attempts - 1
+		if index >= len(c.config.RetryDelays) {
+			index = len(c.config.RetryDelays) - 1
+		}
+		err = c.retry(delivery, attempts, c.config.RetryDelays[index])
+	}
+	// acknowledged only after the confirmation of the republishing, so
+	// that a lost message is delivered again instead of vanishing
+	if err != nil {
+		log.WithError(err).Errorf("cannot reroute message %s, requeueing", delivery.MessageId)
+		_ = delivery.Nack(false, true)
+		return
+	}
+	_ = delivery.Ack(false)
+}
+
+func (c *Consumer) run(ctx context.Context, delivery amqp.Delivery) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("handler panicked: %v", recovered)
+		}
+	}()
+	return c.handler(ctx, delivery)
+}
+
+func (c *Consumer) retry(delivery amqp.Delivery, attempts int, delay time.Duration) error {
+	msg := rabbitRepublishing(delivery)
+	msg.Headers[RABBIT_HEADER_ATTEMPTS] = int32(attempts)
+	return c.publisher.Publish(context.Background(), "", c.retryQueue(delay), msg).Err
+}
+
+func (c *Consumer) deadLetter(delivery amqp.Delivery, attempts int, reason error) error {
+	msg := rabbitRepublishing(delivery)
+	msg.Headers[RABBIT_HEADER_ATTEMPTS] = int32(attempts)
+	msg.Headers[RABBIT_HEADER_FAILURE_REASON] = reason.Error()
+	msg.Headers[RABBIT_HEADER_ORIGINAL_QUEUE] = c.config.Queue
+	if c.config.DeadLetterExchange == "" {
+		return c.publisher.Publish(context.Background(), "", c.deadQueue(), msg).Err
+	}
+	return c.publisher.Publish(context.Background(), c.config.DeadLetterExchange, c.config.DeadLetterKey, msg).Err
+}
+
+func rabbitRepublishing(delivery amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
+
+func rabbitDeliveryAttempts(delivery amqp.Delivery) int {
+	switch value := delivery.Headers[RABBIT_HEADER_ATTEMPTS].(type) {
+	case int8:
+		return int(value)
+	case int16:
+		return int(value)
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	case int:
+		return int(value)
+	}
+	return 0
+}
@@ -0,0 +1,332 @@
+package api_common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// RABBIT_HEADER_EVENT_VERSION contains the schema version of an event;
+// type, id, timestamp, source and content type are the amqp properties
+// Type, MessageId, Timestamp, AppId and ContentType
+const RABBIT_HEADER_EVENT_VERSION = "x-event-version"
+
+const EVENT_TYPE_MONITOR = "api_common.monitor"
+const EVENT_TYPE_NOTIFICATION = "api_common.notification"
+const EVENT_TYPE_ERMES = "api_common.ermes"
+
+// ErrEventUnknownType is returned for events whose type is not registered
+var ErrEventUnknownType = errors.New("unknown event type")
+
+// EventEnvelope is an event with its metadata, as carried by a message
+type EventEnvelope struct {
+	Type        string
+	Version     int
+	Id          string
+	Timestamp   time.Time
+	Source      string
+	ContentType string
+	Body        json.RawMessage
+}
+
+// Publishing returns the message carrying the envelope
+func (e EventEnvelope) Publishing() amqp.Publishing {
+	return amqp.Publishing{
+		Type:         e.Type,
+		MessageId:    e.Id,
+		Timestamp:    e.Timestamp,
+		AppId:        e.Source,
+		ContentType:  e.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Headers:      amqp.Table{RABBIT_HEADER_EVENT_VERSION: int32(e.Version)},
+		Body:         e.Body,
+	}
+}
+
+// EventEnvelopeFromDelivery reads the envelope of a delivery. Messages
+// published without a version are considered version 1
+func EventEnvelopeFromDelivery(delivery amqp.Delivery) EventEnvelope {
+	version := 1
+	switch value := delivery.Headers[RABBIT_HEADER_EVENT_VERSION].(type) {
+	case int16:
+		version = int(value)
+	case int32:
+		version = int(value)
+	case int64:
+		version = int(value)
+	case float64:
+		// the headers of the messages spilled by MonitorSink are json decoded
+		version = int(value)
+	}
+	return EventEnvelope{
+		Type:        delivery.Type,
+		Version:     version,
+		Id:          delivery.MessageId,
+		Timestamp:   delivery.Timestamp,
+		Source:      delivery.AppId,
+		ContentType: delivery.ContentType,
+		Body:        delivery.Body,
+	}
+}
+
+// EventUpcaster converts the body of an event from a version to the next
+type EventUpcaster func(body json.RawMessage) (json.RawMessage, error)
+
+type eventRegistration struct {
+	version int
+	goType  reflect.Type
+}
+
+// EventRegistry maps event types to their current version and Go struct,
+// and holds the upcasters converting the old versions
+type EventRegistry struct {
+	mu        sync.RWMutex
+	types     map[string]eventRegistration
+	names     map[reflect.Type]string
+	upcasters map[string]map[int]EventUpcaster
+}
+
+// DefaultEventRegistry contains the library payloads. EVENT_TYPE_MONITOR
+// is at version 2, which only adds optional fields to version 1
+var DefaultEventRegistry = NewEventRegistry()
+
+func init() {
+	RegisterEvent[MonitorRequest](DefaultEventRegistry, EVENT_TYPE_MONITOR, 2)
+	DefaultEventRegistry.RegisterUpcaster(EVENT_TYPE_MONITOR, 1, func(body json.RawMessage) (json.RawMessage, error) {
+		return body, nil
+	})
+	RegisterEvent[NotificationRequest](DefaultEventRegistry, EVENT_TYPE_NOTIFICATION, 1)
+	RegisterEvent[ErmesQueue](DefaultEventRegistry, EVENT_TYPE_ERMES, 1)
+}
+
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{
+		types:     map[string]eventRegistration{},
+		names:     map[reflect.Type]string{},
+		upcasters: map[string]map[int]EventUpcaster{},
+	}
+}
+
+// RegisterEvent maps eventType at its current version to T
+func RegisterEvent[T any](registry *EventRegistry, eventType string, version int) {
+	goType := reflect.TypeOf((*T)(nil)).Elem()
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.types[eventType] = eventRegistration{version: version, goType: goType}
+	registry.names[goType] = eventType
+}
+
+// RegisterUpcaster registers the conversion of eventType from fromVersion
+// to fromVersion+1
+func (r *EventRegistry) RegisterUpcaster(eventType string, fromVersion int, upcaster EventUpcaster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.upcasters[eventType] == nil {
+		r.upcasters[eventType] = map[int]EventUpcaster{}
+	}
+	r.upcasters[eventType][fromVersion] = upcaster
+}
+
+// NewEnvelope returns a new envelope carrying body as an event of
+// eventType, at its registered version (1 if not registered)
+func (r *EventRegistry) NewEnvelope(eventType string, source string, body []byte) EventEnvelope {
+	r.mu.RLock()
+	version := r.types[eventType].version
+	r.mu.RUnlock()
+	return EventEnvelope{
+		Type:        eventType,
+		Version:     TernaryOperator(version > 0, version, 1).(int),
+		Id:          RequestIdGeneratorUuidV7(),
+		Timestamp:   time.Now().UTC(),
+		Source:      source,
+		ContentType: fiber.MIMEApplicationJSON,
+		Body:        body,
+	}
+}
+
+// TypeOf returns the event type and current version of value, which can
+// be also a pointer to the registered struct
+func (r *EventRegistry) TypeOf(value interface{}) (string, int, error) {
+	goType := reflect.TypeOf(value)
+	if goType != nil && goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, ok := r.names[goType]
+	if !ok {
+		return "", 0, fmt.Errorf("%w: %T", ErrEventUnknownType, value)
+	}
+	return name, r.types[name].version, nil
+}
+
+// Upcast converts the envelope to the current version of its type,
+// applying the upcasters in sequence
+func (r *EventRegistry) Upcast(envelope EventEnvelope) (EventEnvelope, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	registration, ok := r.types[envelope.Type]
+	if !ok {
+		return envelope, fmt.Errorf("%w: %s", ErrEventUnknownType, envelope.Type)
+	}
+	if envelope.Version > registration.version {
+		return envelope, fmt.Errorf("event %s version %d is newer than %d", envelope.Type, envelope.Version, registration.version)
+	}
+	for envelope.Version < registration.version {
+		upcaster, ok := r.upcasters[envelope.Type][envelope.Version]
+		if !ok {
+			return envelope, fmt.Errorf("no upcaster for event %s version %d", envelope.Type, envelope.Version)
+		}
+		body, err := upcaster(envelope.Body)
+		if err != nil {
+			return envelope, fmt.Errorf("cannot upcast event %s version %d: %s", envelope.Type, envelope.Version, err.Error())
+		}
+		envelope.Body = body
+		envelope.Version++
+	}
+	return envelope, nil
+}
+
+// Decode upcasts the envelope and decodes its body into the registered
+// struct, returned as a pointer
+func (r *EventRegistry) Decode(envelope EventEnvelope) (interface{}, error) {
+	envelope, err := r.Upcast(envelope)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	goType := r.types[envelope.Type].goType
+	r.mu.RUnlock()
+	value := reflect.New(goType).Interface()
+	if err = json.Unmarshal(envelope.Body, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// LockedRabbitChannel serializes the use of ch, which is not safe for
+// concurrent publishing. RabbitConnectionManager.WithChannel does the
+// same on a managed connection
+func LockedRabbitChannel(ch *amqp.Channel) func(fn func(ch *amqp.Channel) error) error {
+	var mu sync.Mutex
+	return func(fn func(ch *amqp.Channel) error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return fn(ch)
+	}
+}
+
+type eventSubscription func(ctx context.Context, envelope EventEnvelope) error
+
+// EventBus publishes typed events in an EventEnvelope and dispatches the
+// received ones to the handlers subscribed by type
+type EventBus struct {
+	Registry *EventRegistry
+	Source   string
+
+	withChannel   func(fn func(ch *amqp.Channel) error) error
+	mu            sync.RWMutex
+	subscriptions map[string]eventSubscription
+}
+
+// NewEventBus returns a bus on DefaultEventRegistry publishing with
+// withChannel, e.g. RabbitConnectionManager.WithChannel or
+// LockedRabbitChannel
+func NewEventBus(source string, withChannel func(fn func(ch *amqp.Channel) error) error) *EventBus {
+	return &EventBus{
+		Registry:      DefaultEventRegistry,
+		Source:        source,
+		withChannel:   withChannel,
+		subscriptions: map[string]eventSubscription{},
+	}
+}
+
+// Publish publishes event, whose type must be registered, with
+// PublishWithContext
+func Publish[T any](ctx context.Context, bus *EventBus, exchange string, key string, event T) error {
+	eventType, _, err := bus.Registry.TypeOf(event)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	envelope := bus.Registry.NewEnvelope(eventType, bus.Source, body)
+	return bus.withChannel(func(ch *amqp.Channel) error {
+		return PublishWithContext(ctx, ch, exchange, key, envelope.Publishing())
+	})
+}
+
+// Subscribe registers handler for the events of type T, upcast to the
+// current version
+func Subscribe[T any](bus *EventBus, handler func(ctx context.Context, envelope EventEnvelope, event T) error) error {
+	var zero T
+	eventType, _, err := bus.Registry.TypeOf(zero)
+	if err != nil {
+		return err
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.subscriptions[eventType] = func(ctx context.Context, envelope EventEnvelope) error {
+		envelope, err := bus.Registry.Upcast(envelope)
+		if err != nil {
+			return RabbitPermanentError(err)
+		}
+		var event T
+		if err = json.Unmarshal(envelope.Body, &event); err != nil {
+			return RabbitPermanentError(err)
+		}
+		return handler(ctx, envelope, event)
+	}
+	return nil
+}
+
+// Handler returns the RabbitHandler dispatching the events to the
+// subscriptions, to be used with a Consumer. Events without subscription
+// are dead-lettered
+func (b *EventBus) Handler() RabbitHandler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		envelope := EventEnvelopeFromDelivery(delivery)
+		b.mu.RLock()
+		subscription, ok := b.subscriptions[envelope.Type]
+		b.mu.RUnlock()
+		if !ok {
+			return RabbitPermanentError(fmt.Errorf("%w: %s", ErrEventUnknownType, envelope.Type))
+		}
+		return subscription(ctx, envelope)
+	}
+}
+
+// Consume dispatches the deliveries of GetRabbitConsumer until ctx is
+// done or the channel is closed. Being auto-acked, failed events are
+// only logged
+func (b *EventBus) Consume(ctx context.Context, queue string, deliveries <-chan amqp.Delivery) {
+	handler := b.Handler()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			spanCtx, span := StartRabbitConsumerSpan(ctx, delivery, queue)
+			err := handler(spanCtx, delivery)
+			RecordRabbitConsumed(queue, err)
+			if err != nil {
+				span.RecordError(err)
+				log.WithError(err).Errorf("cannot handle event %s of type %s", delivery.MessageId, delivery.Type)
+			}
+			span.End()
+		}
+	}
+}
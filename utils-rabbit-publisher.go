@@ -0,0 +1,313 @@
+package api_common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const rabbitDefaultPublishRetries = 3
+const rabbitDefaultConfirmTimeout = 5 * time.Second
+
+// ErrRabbitNack is returned when the broker negatively acknowledges a message
+var ErrRabbitNack = errors.New("message not acknowledged by rabbit")
+
+// ErrRabbitUnroutable is returned when a mandatory message cannot be routed
+// to any queue, e.g. a wrong exchange or routing key
+var ErrRabbitUnroutable = errors.New("message unroutable")
+
+// ErrRabbitConfirmTimeout is returned when the confirmation does not arrive
+// within ConfirmTimeout
+var ErrRabbitConfirmTimeout = errors.New("rabbit confirmation timeout")
+
+// PublishConfirmation is the outcome of a reliable publish
+type PublishConfirmation struct {
+	Exchange  string
+	Key       string
+	MessageId string
+	Attempts  int
+	Err       error
+}
+
+// rabbitPendingPublish waits for its confirmation in owner, the pending
+// map of the channel it was published on
+type rabbitPendingPublish struct {
+	messageId string
+	tag       uint64
+	owner     map[uint64]*rabbitPendingPublish
+	done      chan error
+}
+
+// ReliablePublisher publishes on a dedicated channel in confirm mode:
+// every message is correlated with its ack/nack by sequence number, is
+// published as mandatory so that unroutable messages are reported through
+// NotifyReturn instead of vanishing, and is retried with backoff when
+// nacked or when the channel drops
+type ReliablePublisher struct {
+	MaxRetries     int
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	ConfirmTimeout time.Duration
+	// Mandatory reports unroutable messages as ErrRabbitUnroutable
+	Mandatory bool
+
+	open    func() (*amqp.Channel, error)
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	seq     uint64
+	pending map[uint64]*rabbitPendingPublish
+	closed  bool
+}
+
+// NewReliablePublisher returns a publisher opening its channel with open,
+// which is called again whenever the channel is closed
+func NewReliablePublisher(open func() (*amqp.Channel, error)) *ReliablePublisher {
+	return &ReliablePublisher{
+		MaxRetries:     rabbitDefaultPublishRetries,
+		MinBackoff:     rabbitDefaultMinBackoff,
+		MaxBackoff:     rabbitDefaultMaxBackoff,
+		ConfirmTimeout: rabbitDefaultConfirmTimeout,
+		Mandatory:      true,
+		open:           open,
+	}
+}
+
+// NewReliablePublisher returns a publisher on a channel of the managed
+// connection, reopened after reconnections
+func (m *RabbitConnectionManager) NewReliablePublisher() *ReliablePublisher {
+	return NewReliablePublisher(m.Channel)
+}
+
+func (p *ReliablePublisher) channel() (*amqp.Channel, error) {
+	if p.closed {
+		return nil, ErrRabbitManagerClosed
+	}
+	if p.ch != nil {
+		return p.ch, nil
+	}
+	ch, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	p.ch = ch
+	p.seq = 0
+	// every channel has its own pending map, so that the listener of a
+	// closed channel never fails the publishes of the next one
+	pending := map[uint64]*rabbitPendingPublish{}
+	p.pending = pending
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 64))
+	go p.listen(ch, pending, confirms, returns)
+	return ch, nil
+}
+
+func (p *ReliablePublisher) listen(ch *amqp.Channel, pendings map[uint64]*rabbitPendingPublish, confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	returned := map[string]amqp.Return{}
+	for confirm := range confirms {
+		// the broker sends basic.return before the ack of the same message,
+		// so pending returns are always available here
+	drain:
+		for {
+			select {
+			case r := <-returns:
+				returned[r.MessageId] = r
+			default:
+				break drain
+			}
+		}
+		p.mu.Lock()
+		pending, ok := pendings[confirm.DeliveryTag]
+		delete(pendings, confirm.DeliveryTag)
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+		r, isReturned := returned[pending.messageId]
+		delete(returned, pending.messageId)
+		switch {
+		case !confirm.Ack:
+			pending.done <- ErrRabbitNack
+		case isReturned:
+			pending.done <- fmt.Errorf("%w: %d %s", ErrRabbitUnroutable, r.ReplyCode, r.ReplyText)
+		default:
+			pending.done <- nil
+		}
+	}
+	// confirms is closed with the channel: fail what is still pending
+	p.mu.Lock()
+	if p.ch == ch {
+		p.ch = nil
+	}
+	for tag, pending := range pendings {
+		pending.done <- amqp.ErrClosed
+		delete(pendings, tag)
+	}
+	p.mu.Unlock()
+}
+
+func (p *ReliablePublisher) send(exchange string, key string, msg amqp.Publishing) (*rabbitPendingPublish, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, err := p.channel()
+	if err != nil {
+		return nil, err
+	}
+	tag := p.seq + 1
+	pending := &rabbitPendingPublish{messageId: msg.MessageId, tag: tag, owner: p.pending, done: make(chan error, 1)}
+	p.pending[tag] = pending
+	if err = ch.Publish(exchange, key, p.Mandatory, false, msg); err != nil {
+		delete(p.pending, tag)
+		if err == amqp.ErrClosed {
+			p.ch = nil
+		}
+		return nil, err
+	}
+	p.seq = tag
+	return pending, nil
+}
+
+func (p *ReliablePublisher) wait(ctx context.Context, pending *rabbitPendingPublish) error {
+	timeout := time.NewTimer(p.ConfirmTimeout)
+	defer timeout.Stop()
+	var err error
+	select {
+	case err = <-pending.done:
+		return err
+	case <-timeout.C:
+		err = ErrRabbitConfirmTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// the confirmation may never come: stop waiting for it
+	p.mu.Lock()
+	if pending.owner[pending.tag] == pending {
+		delete(pending.owner, pending.tag)
+	}
+	p.mu.Unlock()
+	return err
+}
+
+func (p *ReliablePublisher) backoff(attempt int) time.Duration {
+	delay := p.MinBackoff << uint(attempt)
+	if delay <= 0 || delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+func (p *ReliablePublisher) publish(ctx context.Context, exchange string, key string, msg amqp.Publishing, pending *rabbitPendingPublish) PublishConfirmation {
+	confirmation := PublishConfirmation{Exchange: exchange, Key: key, MessageId: msg.MessageId}
+	for attempt := 0; ; attempt++ {
+		confirmation.Attempts = attempt + 1
+		var err error
+		if pending == nil {
+			pending, err = p.send(exchange, key, msg)
+		}
+		if err == nil {
+			err = p.wait(ctx, pending)
+		}
+		pending = nil
+		confirmation.Err = err
+		// unroutable messages are a configuration error: retrying is useless
+		if err == nil || errors.Is(err, ErrRabbitUnroutable) || errors.Is(err, ErrRabbitManagerClosed) ||
+			ctx.Err() != nil || attempt >= p.MaxRetries {
+			metricRabbitPublished.Inc(exchange, key, metricsResult(err))
+			return confirmation
+		}
+		delay := p.backoff(attempt)
+		log.WithError(err).Warnf("cannot publish message %s, retrying in %s", msg.MessageId, delay)
+		select {
+		case <-ctx.Done():
+			confirmation.Err = ctx.Err()
+			metricRabbitPublished.Inc(exchange, key, metricsResult(confirmation.Err))
+			return confirmation
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (p *ReliablePublisher) message(ctx context.Context, body []byte) amqp.Publishing {
+	return amqp.Publishing{
+		MessageId:   RequestIdGeneratorUuidV7(),
+		Timestamp:   time.Now(),
+		ContentType: fiber.MIMEApplicationJSON,
+		Body:        body,
+		Headers:     RabbitHeadersWithRequestId(ctx, RabbitHeadersWithTrace(ctx, nil)),
+	}
+}
+
+// Publish publishes the message and waits for the broker confirmation,
+// retrying with backoff on nacks, timeouts and closed channels. A missing
+// MessageId is generated, since it is used to correlate returns
+func (p *ReliablePublisher) Publish(ctx context.Context, exchange string, key string, msg amqp.Publishing) PublishConfirmation {
+	if msg.MessageId == "" {
+		msg.MessageId = RequestIdGeneratorUuidV7()
+	}
+	return p.publish(ctx, exchange, key, msg, nil)
+}
+
+// PublishAsync publishes the message without waiting: callback is called
+// with the outcome, after the retries. The returned error is only about
+// the first send
+func (p *ReliablePublisher) PublishAsync(ctx context.Context, exchange string, key string, msg amqp.Publishing, callback func(PublishConfirmation)) error {
+	if msg.MessageId == "" {
+		msg.MessageId = RequestIdGeneratorUuidV7()
+	}
+	pending, err := p.send(exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	go func() {
+		confirmation := p.publish(ctx, exchange, key, msg, pending)
+		if callback != nil {
+			callback(confirmation)
+		}
+	}()
+	return nil
+}
+
+// PublishMessage is the reliable version of PublishMessageWithContext: it
+// publishes json within a producer span and waits for the confirmation
+func (p *ReliablePublisher) PublishMessage(ctx context.Context, exchange string, key string, json []byte) error {
+	spanCtx, span := GetTracer().StartSpan(ctx, exchange+" publish", SPAN_KIND_PRODUCER)
+	defer span.End()
+	span.SetAttribute("messaging.system", "rabbitmq")
+	span.SetAttribute("messaging.destination", exchange)
+	span.SetAttribute("messaging.rabbitmq.routing_key", key)
+	msg := p.message(spanCtx, json)
+	span.SetAttribute("messaging.message_id", msg.MessageId)
+	confirmation := p.publish(spanCtx, exchange, key, msg, nil)
+	if confirmation.Err != nil {
+		span.RecordError(confirmation.Err)
+		return confirmation.Err
+	}
+	return nil
+}
+
+// PublishMessageAsync is the asynchronous version of PublishMessage
+func (p *ReliablePublisher) PublishMessageAsync(ctx context.Context, exchange string, key string, json []byte, callback func(PublishConfirmation)) error {
+	return p.PublishAsync(ctx, exchange, key, p.message(ctx, json), callback)
+}
+
+// Close closes the channel, failing the pending confirmations
+func (p *ReliablePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.ch == nil {
+		return nil
+	}
+	ch := p.ch
+	p.ch = nil
+	return ch.Close()
+}
@@ -0,0 +1,297 @@
+package api_common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// RABBIT_DIRECT_REPLY_TO is the pseudo-queue of the rabbit direct reply-to
+const RABBIT_DIRECT_REPLY_TO = "amq.rabbitmq.reply-to"
+
+// ErrRpcClosed is returned by the calls pending when the client is closed
+// or its channel drops
+var ErrRpcClosed = errors.New("rpc client closed")
+
+// RpcError is the error replied by the server
+type RpcError struct {
+	ErrorCode string
+	Reason    string
+	Detail    string
+}
+
+func (e *RpcError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ErrorCode, TernaryOperator(e.Detail != "", e.Detail, e.Reason).(string))
+}
+
+// RpcClient sends RpcRequest messages and correlates the replies by
+// correlation id. Replies are received on the direct reply-to
+// pseudo-queue or, with DirectReplyTo false, on an exclusive queue
+type RpcClient struct {
+	DirectReplyTo bool
+
+	open       func() (*amqp.Channel, error)
+	mu         sync.Mutex
+	ch         *amqp.Channel
+	replyQueue string
+	pending    map[string]chan amqp.Delivery
+	closed     bool
+}
+
+// NewRpcClient returns a client opening its channel with open, which is
+// called again when the channel is closed
+func NewRpcClient(open func() (*amqp.Channel, error), directReplyTo bool) *RpcClient {
+	return &RpcClient{DirectReplyTo: directReplyTo, open: open}
+}
+
+// NewRpcClient returns a client on a channel of the managed connection
+func (m *RabbitConnectionManager) NewRpcClient(directReplyTo bool) *RpcClient {
+	return NewRpcClient(m.Channel, directReplyTo)
+}
+
+func (c *RpcClient) channel() (*amqp.Channel, error) {
+	if c.closed {
+		return nil, ErrRpcClosed
+	}
+	if c.ch != nil {
+		return c.ch, nil
+	}
+	ch, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	replyQueue := RABBIT_DIRECT_REPLY_TO
+	if !c.DirectReplyTo {
+		queue, errQueue := ch.QueueDeclare("", false, true, true, false, nil)
+		if errQueue != nil {
+			_ = ch.Close()
+			return nil, errQueue
+		}
+		replyQueue = queue.Name
+	}
+	// direct reply-to requires consuming in no-ack mode before publishing
+	replies, err := ch.Consume(replyQueue, "", true, true, false, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	c.ch = ch
+	c.replyQueue = replyQueue
+	c.pending = map[string]chan amqp.Delivery{}
+	go c.dispatch(ch, replies)
+	return ch, nil
+}
+
+func (c *RpcClient) dispatch(ch *amqp.Channel, replies <-chan amqp.Delivery) {
+	for reply := range replies {
+		c.mu.Lock()
+		pending, ok := c.pending[reply.CorrelationId]
+		delete(c.pending, reply.CorrelationId)
+		c.mu.Unlock()
+		if !ok {
+			log.Warnf("rpc reply with unknown correlation id %s", reply.CorrelationId)
+			continue
+		}
+		pending <- reply
+	}
+	c.mu.Lock()
+	if c.ch == ch {
+		c.ch = nil
+		for correlationId, pending := range c.pending {
+			close(pending)
+			delete(c.pending, correlationId)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Call sends payload to method and waits for the reply until ctx is done
+func (c *RpcClient) Call(ctx context.Context, exchange string, key string, method string, payload []byte) (RpcResponse, error) {
+	var response RpcResponse
+	body, err := json.Marshal(RpcRequest{Data: RpcRequestData{Method: method, Payload: payload}})
+	if err != nil {
+		return response, err
+	}
+	spanCtx, span := GetTracer().StartSpan(ctx, method+" call", SPAN_KIND_CLIENT)
+	defer span.End()
+	span.SetAttribute("rpc.system", "rabbitmq")
+	span.SetAttribute("rpc.method", method)
+
+	correlationId := RequestIdGeneratorUuidV7()
+	reply := make(chan amqp.Delivery, 1)
+	c.mu.Lock()
+	ch, err := c.channel()
+	if err == nil {
+		c.pending[correlationId] = reply
+		err = ch.Publish(exchange, key, false, false, amqp.Publishing{
+			ContentType:   fiber.MIMEApplicationJSON,
+			CorrelationId: correlationId,
+			ReplyTo:       c.replyQueue,
+			MessageId:     correlationId,
+			Type:          method,
+			Body:          body,
+			Headers:       RabbitHeadersWithRequestId(spanCtx, RabbitHeadersWithTrace(spanCtx, nil)),
+		})
+		if err != nil {
+			delete(c.pending, correlationId)
+		}
+	}
+	c.mu.Unlock()
+	metricRabbitPublished.Inc(exchange, key, metricsResult(err))
+	if err != nil {
+		span.RecordError(err)
+		return response, err
+	}
+
+	select {
+	case delivery, ok := <-reply:
+		if !ok {
+			err = ErrRpcClosed
+		} else {
+			err = json.Unmarshal(delivery.Body, &response)
+		}
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, correlationId)
+		c.mu.Unlock()
+		err = ctx.Err()
+	}
+	if err == nil && response.Error != nil {
+		err = &RpcError{ErrorCode: response.Error.ErrorCode, Reason: response.Error.Reason, Detail: response.Error.Detail}
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	return response, err
+}
+
+// Close closes the channel, failing the pending calls
+func (c *RpcClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.ch == nil {
+		return nil
+	}
+	ch := c.ch
+	c.ch = nil
+	for correlationId, pending := range c.pending {
+		close(pending)
+		delete(c.pending, correlationId)
+	}
+	return ch.Close()
+}
+
+// RpcCall calls method with a typed request, decoding the typed response
+func RpcCall[Req any, Res any](ctx context.Context, client *RpcClient, exchange string, key string, method string, request Req) (Res, error) {
+	var result Res
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return result, err
+	}
+	response, err := client.Call(ctx, exchange, key, method, payload)
+	if err != nil {
+		return result, err
+	}
+	if len(response.Data) > 0 {
+		err = json.Unmarshal(response.Data, &result)
+	}
+	return result, err
+}
+
+// RpcHandler handles the payload of a method, returning the reply data
+type RpcHandler func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+// RpcServer dispatches RpcRequest messages to the handlers registered by
+// method, replying to the ReplyTo of the message or, if missing, to the
+// RabbitReply route of the request. Its Handler is used with a Consumer
+type RpcServer struct {
+	withChannel func(fn func(ch *amqp.Channel) error) error
+	mu          sync.RWMutex
+	handlers    map[string]RpcHandler
+}
+
+// NewRpcServer returns a server publishing the replies with withChannel,
+// e.g. RabbitConnectionManager.WithChannel
+func NewRpcServer(withChannel func(fn func(ch *amqp.Channel) error) error) *RpcServer {
+	return &RpcServer{withChannel: withChannel, handlers: map[string]RpcHandler{}}
+}
+
+// Handle registers the handler of method
+func (s *RpcServer) Handle(method string, handler RpcHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = handler
+}
+
+// RpcHandle registers a handler with typed request and response
+func RpcHandle[Req any, Res any](server *RpcServer, method string, handler func(ctx context.Context, request Req) (Res, error)) {
+	server.Handle(method, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		var request Req
+		if len(payload) > 0 {
+			if err := json.Unmarshal(payload, &request); err != nil {
+				return nil, RabbitPermanentError(err)
+			}
+		}
+		return handler(ctx, request)
+	})
+}
+
+// Handler returns the RabbitHandler dispatching the requests. Handler
+// errors are replied to the caller; only a failed reply is returned, so
+// that the request is retried
+func (s *RpcServer) Handler() RabbitHandler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		var request RpcRequest
+		if err := json.Unmarshal(delivery.Body, &request); err != nil {
+			return RabbitPermanentError(err)
+		}
+		exchange, key := "", delivery.ReplyTo
+		if key == "" {
+			exchange = request.Data.RabbitReply.Exchange
+			key = TernaryOperator(request.Data.RabbitReply.Key != "", request.Data.RabbitReply.Key, request.Data.RabbitReply.Queue).(string)
+		}
+		method := TernaryOperator(request.Data.Method != "", request.Data.Method, delivery.Type).(string)
+
+		s.mu.RLock()
+		handler, ok := s.handlers[method]
+		s.mu.RUnlock()
+		var response RpcResponse
+		if !ok {
+			response.Error = &Error{ErrorCode: API_CODE_COMMON_METHOD_NOT_FOUND, Reason: fmt.Sprintf("unknown method %s", method)}
+		} else if data, err := handler(ctx, request.Data.Payload); err != nil {
+			var permanent rabbitPermanentError
+			code := TernaryOperator(errors.As(err, &permanent), API_CODE_COMMON_BAD_REQUEST, API_CODE_COMMON_INTERNAL_SERVER_ERROR).(string)
+			response.Error = &Error{ErrorCode: code, Reason: err.Error()}
+		} else if response.Data, err = json.Marshal(data); err != nil {
+			return err
+		} else {
+			response.Status = true
+		}
+		if key == "" {
+			// fire and forget request
+			return nil
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		return s.withChannel(func(ch *amqp.Channel) error {
+			err := ch.Publish(exchange, key, false, false, amqp.Publishing{
+				ContentType:   fiber.MIMEApplicationJSON,
+				CorrelationId: delivery.CorrelationId,
+				Type:          method,
+				Body:          body,
+				Headers:       RabbitHeadersWithRequestId(ctx, RabbitHeadersWithTrace(ctx, nil)),
+			})
+			metricRabbitPublished.Inc(exchange, key, metricsResult(err))
+			return err
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package api_common
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+const RABBIT_TOPOLOGY_CREATE = "create"
+const RABBIT_TOPOLOGY_EXISTS = "exists"
+const RABBIT_TOPOLOGY_ENSURE = "ensure"
+
+const rabbitDefaultExchangeType = amqp.ExchangeDirect
+
+// RabbitTopologyChange is an entry of the dry-run diff: Action is
+// RABBIT_TOPOLOGY_CREATE for a missing exchange or queue,
+// RABBIT_TOPOLOGY_EXISTS for an existing one and RABBIT_TOPOLOGY_ENSURE
+// for bindings, which cannot be inspected over amqp. The settings of the
+// existing entities are not compared
+type RabbitTopologyChange struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+func (c RabbitTopologyChange) String() string {
+	return fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+}
+
+// GetRabbitTopology returns the topology declared in the config. The
+// routes of Producer, Consumer, Monitor and Notification are not added,
+// since their settings are owned by whoever declared them
+func GetRabbitTopology(rabbit Rabbit) RabbitTopology {
+	return RabbitTopology{
+		Exchanges: append([]RabbitExchange{}, rabbit.Topology.Exchanges...),
+		Queues:    append([]RabbitQueue{}, rabbit.Topology.Queues...),
+		Bindings:  append([]RabbitBinding{}, rabbit.Topology.Bindings...),
+	}
+}
+
+// GetRabbitRoutesTopology returns the exchanges and queues of Producer,
+// Consumer, Monitor and Notification not listed in the topology of the
+// config. They are only checked with DiffRabbitTopology, never declared
+func GetRabbitRoutesTopology(rabbit Rabbit) RabbitTopology {
+	var routes RabbitTopology
+	for _, info := range []RabbitInfo{rabbit.Producer, rabbit.Consumer, rabbit.Monitor, rabbit.Notification} {
+		if info.Exchange != "" && !rabbit.Topology.hasExchange(info.Exchange) && !routes.hasExchange(info.Exchange) {
+			routes.Exchanges = append(routes.Exchanges, RabbitExchange{Name: info.Exchange, Type: rabbitDefaultExchangeType, Durable: true})
+		}
+		if info.Queue != "" && !rabbit.Topology.hasQueue(info.Queue) && !routes.hasQueue(info.Queue) {
+			routes.Queues = append(routes.Queues, RabbitQueue{Name: info.Queue, Durable: true})
+		}
+	}
+	return routes
+}
+
+func (t RabbitTopology) hasExchange(name string) bool {
+	for _, exchange := range t.Exchanges {
+		if exchange.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t RabbitTopology) hasQueue(name string) bool {
+	for _, queue := range t.Queues {
+		if queue.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the topology before declaring it
+func (t RabbitTopology) Validate() error {
+	for _, exchange := range t.Exchanges {
+		if exchange.Name == "" {
+			return errors.New("exchange without name")
+		}
+	}
+	for _, queue := range t.Queues {
+		if queue.Name == "" {
+			return errors.New("queue without name")
+		}
+		if queue.Quorum && (!queue.Durable || queue.Exclusive || queue.AutoDelete) {
+			return fmt.Errorf("quorum queue %s must be durable, not exclusive and not auto-delete", queue.Name)
+		}
+	}
+	for _, binding := range t.Bindings {
+		if binding.Queue == "" || binding.Exchange == "" {
+			return fmt.Errorf("binding %s -> %s without exchange or queue", binding.Exchange, binding.Queue)
+		}
+		if !t.hasExchange(binding.Exchange) || !t.hasQueue(binding.Queue) {
+			return fmt.Errorf("binding %s -> %s references an undeclared exchange or queue", binding.Exchange, binding.Queue)
+		}
+	}
+	return nil
+}
+
+func (q RabbitQueue) arguments() amqp.Table {
+	args := amqp.Table{}
+	if q.Quorum {
+		args["x-queue-type"] = "quorum"
+	}
+	if q.MessageTtlMs > 0 {
+		args["x-message-ttl"] = q.MessageTtlMs
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	if q.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = q.MaxLengthBytes
+	}
+	if q.Overflow != "" {
+		args["x-overflow"] = q.Overflow
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// DeclareRabbitTopology declares exchanges, queues and bindings. It is
+// idempotent: declaring an existing entity with the same arguments is a
+// no-op, while different arguments make the broker close the channel
+// with PRECONDITION_FAILED. To redeclare after reconnections use it with
+// RabbitConnectionManager.DeclareTopology
+func DeclareRabbitTopology(ch *amqp.Channel, topology RabbitTopology) error {
+	if err := topology.Validate(); err != nil {
+		return err
+	}
+	for _, exchange := range topology.Exchanges {
+		kind := TernaryOperator(exchange.Type == "", rabbitDefaultExchangeType, exchange.Type).(string)
+		if err := ch.ExchangeDeclare(exchange.Name, kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, nil); err != nil {
+			return fmt.Errorf("cannot declare exchange %s: %s", exchange.Name, err.Error())
+		}
+	}
+	for _, queue := range topology.Queues {
+		if _, err := ch.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, queue.arguments()); err != nil {
+			return fmt.Errorf("cannot declare queue %s: %s", queue.Name, err.Error())
+		}
+	}
+	for _, binding := range topology.Bindings {
+		if err := ch.QueueBind(binding.Queue, binding.Key, binding.Exchange, false, nil); err != nil {
+			return fmt.Errorf("cannot bind queue %s to exchange %s: %s", binding.Queue, binding.Exchange, err.Error())
+		}
+	}
+	return nil
+}
+
+// DiffRabbitTopology is the dry-run of DeclareRabbitTopology: it returns
+// the changes it would apply, without modifying the broker. Every
+// passive check uses a new channel from open, since the broker closes
+// the channel when the entity does not exist.
+//
+// The dry run only checks that each entity exists: the broker ignores the
+// arguments of QueueDeclarePassive (TTL, quorum, max length, dead
+// lettering...) and the flags are not compared either, so an entity
+// declared with different settings is reported as RABBIT_TOPOLOGY_EXISTS
+// and DeclareRabbitTopology then fails with PRECONDITION_FAILED. Compare
+// the settings with the management API if needed
+func DiffRabbitTopology(open func() (*amqp.Channel, error), topology RabbitTopology) ([]RabbitTopologyChange, error) {
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+	var changes []RabbitTopologyChange
+	passive := func(kind string, name string, check func(ch *amqp.Channel) error) error {
+		ch, err := open()
+		if err != nil {
+			return err
+		}
+		err = check(ch)
+		_ = ch.Close()
+		action := RABBIT_TOPOLOGY_EXISTS
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			action = RABBIT_TOPOLOGY_CREATE
+		} else if err != nil {
+			return err
+		}
+		changes = append(changes, RabbitTopologyChange{Kind: kind, Name: name, Action: action})
+		return nil
+	}
+	for _, exchange := range topology.Exchanges {
+		exchange := exchange
+		kind := TernaryOperator(exchange.Type == "", rabbitDefaultExchangeType, exchange.Type).(string)
+		err := passive("exchange", exchange.Name, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclarePassive(exchange.Name, kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, queue := range topology.Queues {
+		queue := queue
+		err := passive("queue", queue.Name, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclarePassive(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, queue.arguments())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, binding := range topology.Bindings {
+		changes = append(changes, RabbitTopologyChange{
+			Kind:   "binding",
+			Name:   fmt.Sprintf("%s -> %s (%s)", binding.Exchange, binding.Queue, binding.Key),
+			Action: RABBIT_TOPOLOGY_ENSURE,
+		})
+	}
+	return changes, nil
+}
@@ -1,13 +1,34 @@
 package api_common
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/streadway/amqp"
+	"time"
 )
 
+// GetRabbitConnectionAndChannel dials the broker and opens a channel,
+// returning also the connection so that it can be closed at shutdown
+func GetRabbitConnectionAndChannel(url string) (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, ch, nil
+}
+
+// GetRabbitChannel dials the broker and opens a channel, without any
+// reconnection when the connection drops.
+//
+// Deprecated: use RabbitConnectionManager
 func GetRabbitChannel(url string) (*amqp.Channel, error) {
 	var err error
 	var conn *amqp.Connection
@@ -26,19 +47,47 @@ func GetRabbitChannel(url string) (*amqp.Channel, error) {
 	return ch, nil
 }
 
+// PublishMessage publishes without waiting for the broker confirmation,
+// so unroutable messages are lost silently: use ReliablePublisher when
+// delivery matters
 func PublishMessage(channel *amqp.Channel, exchange string, key string, json []byte) error {
-	err := channel.Publish(
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{Body: json})
+	return PublishMessageWithContext(context.Background(), channel, exchange, key, json)
+}
+
+// PublishMessageWithContext publishes the message within a producer
+// span, propagating the trace context and the request id of ctx in
+// the amqp headers
+func PublishMessageWithContext(ctx context.Context, channel *amqp.Channel, exchange string, key string, json []byte) error {
+	return PublishWithContext(ctx, channel, exchange, key, amqp.Publishing{Body: json})
+}
+
+// PublishWithContext is PublishMessageWithContext for a message with
+// properties: the trace and request id headers are added to msg.Headers
+func PublishWithContext(ctx context.Context, channel *amqp.Channel, exchange string, key string, msg amqp.Publishing) error {
+	spanCtx, span := GetTracer().StartSpan(ctx, exchange+" publish", SPAN_KIND_PRODUCER)
+	defer span.End()
+	span.SetAttribute("messaging.system", "rabbitmq")
+	span.SetAttribute("messaging.destination", exchange)
+	span.SetAttribute("messaging.rabbitmq.routing_key", key)
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	msg.Headers = RabbitHeadersWithRequestId(spanCtx, RabbitHeadersWithTrace(spanCtx, headers))
+	err := channel.Publish(exchange, key, false, false, msg)
+	metricRabbitPublished.Inc(exchange, key, metricsResult(err))
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 	return nil
 }
 
+// PublishToMonitor sends the response to the monitor queue, through the
+// MonitorSink if one is set with SetMonitorSink, so that the request
+// does not wait for the broker. Within MonitorMiddleware the response is
+// only recorded, and sent by the middleware once the request completes:
+// if it is called more than once, the last response is sent
 func PublishToMonitor(response interface{}, c *fiber.Ctx, status int, channel *amqp.Channel, exchange string, key string, source string, sourceType string, uuid *string, url *string) error {
 	jsonResponse, err := json.Marshal(response)
 	if err != nil {
@@ -50,6 +99,16 @@ func PublishToMonitor(response interface{}, c *fiber.Ctx, status int, channel *a
 		uuidStr = *uuid
 		urlStr = *url
 	} else {
+		if state := getMonitorState(c); state != nil {
+			state.captured = true
+			state.response = jsonResponse
+			state.sourceType = sourceType
+			state.url = ""
+			if url != nil {
+				state.url = *url
+			}
+			return nil
+		}
 		if url == nil {
 			urlStr = c.OriginalURL()
 		} else {
@@ -58,29 +117,53 @@ func PublishToMonitor(response interface{}, c *fiber.Ctx, status int, channel *a
 		uuidStr = c.Locals(CTX_REQUESTID).(string)
 	}
 
-	base64Response := base64.URLEncoding.EncodeToString(jsonResponse)
-	monitorRequest := MonitorRequest{Data: MonitorData{Monitor: Monitor{
-		Response:   base64Response,
-		Uuid:       uuidStr,
-		Source:     source,
-		SourceType: sourceType,
-		Success:    TernaryOperator(status != 200, false, true).(bool),
-		Status:     status,
-		Endpoint:   urlStr,
-	}}}
+	base64Response := base64.URLEncoding.EncodeToString(GetRedactor().RedactJSON(jsonResponse))
+	monitor := Monitor{
+		Response:     base64Response,
+		Uuid:         uuidStr,
+		Source:       source,
+		SourceType:   sourceType,
+		Success:      TernaryOperator(status != 200, false, true).(bool),
+		Status:       status,
+		Endpoint:     urlStr,
+		ResponseSize: len(jsonResponse),
+	}
+	ctx := context.Background()
+	if c != nil {
+		ctx = c.UserContext()
+		enrichMonitor(c, &monitor, time.Time{})
+	}
+	return publishMonitor(ctx, monitor, channel, exchange, key)
+}
 
-	var monitorJson []byte
-	monitorJson, err = json.Marshal(monitorRequest)
+func publishMonitor(ctx context.Context, monitor Monitor, channel *amqp.Channel, exchange string, key string) error {
+	monitorJson, err := json.Marshal(MonitorRequest{Data: MonitorData{Monitor: monitor}})
 	if err != nil {
 		return err
 	}
-	err = PublishMessage(channel, exchange, key, monitorJson)
+	msg := DefaultEventRegistry.NewEnvelope(EVENT_TYPE_MONITOR, monitor.Source, monitorJson).Publishing()
+	if sink := GetMonitorSink(); sink != nil {
+		return sink.EnqueuePublishing(ctx, exchange, key, msg)
+	}
+	return PublishWithContext(ctx, channel, exchange, key, msg)
+}
+
+// PublishToNotification publishes the given notification on the
+// notification exchange and key
+func PublishToNotification(notification Notification, channel *amqp.Channel, exchange string, key string) error {
+	notificationJson, err := json.Marshal(NotificationRequest{Data: NotificationData{Notification: notification}})
 	if err != nil {
 		return err
 	}
-	return err
+	msg := DefaultEventRegistry.NewEnvelope(EVENT_TYPE_NOTIFICATION, "", notificationJson).Publishing()
+	return PublishWithContext(context.Background(), channel, exchange, key, msg)
 }
 
+// GetRabbitConsumer starts consuming the given queue. Use
+// StartRabbitConsumerSpan on each delivery to continue the trace
+// propagated by PublishMessageWithContext and count it, and
+// RecordRabbitConsumed with the outcome. Messages are auto-acked, so
+// they are lost if the handler fails: use Consumer when that matters
 func GetRabbitConsumer(ch *amqp.Channel, queue string) (<-chan amqp.Delivery, error) {
 	var err error
 	var msgs <-chan amqp.Delivery
@@ -124,7 +207,8 @@ func PublishToErmes(response interface{}, status int, email string, template str
 	if err != nil {
 		return 500, GetErrorResponse(API_CODE_COMMON_INTERNAL_SERVER_ERROR, "create user", "cannot marshal message for ermes"), err
 	}
-	err = PublishMessage(channel, ermesExchange, ermesKey, jsn)
+	msg := DefaultEventRegistry.NewEnvelope(EVENT_TYPE_ERMES, "", jsn).Publishing()
+	err = PublishWithContext(context.Background(), channel, ermesExchange, ermesKey, msg)
 	if err != nil {
 		return 500, GetErrorResponse(API_CODE_COMMON_INTERNAL_SERVER_ERROR, "create user", "cannot publish to ermes"), err
 	}